@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/tectiv3/go-lsp"
+	"go.bug.st/json"
+)
+
+// Requests of the IDE API. Fields tagged required must be present, validate
+// checks the values.
+
+type textDocumentParam struct {
+	URI string `json:"uri,required"`
+}
+
+// documentRequest is the base of requests for a document, the language
+// server is chosen by languageId or the document uri.
+type documentRequest struct {
+	TextDocument textDocumentParam `json:"textDocument,required"`
+	LanguageId   string            `json:"languageId,omitempty"`
+}
+
+// documentParams are requests sent to the language server of a document.
+type documentParams interface {
+	document() (languageId, uri string)
+}
+
+func (r documentRequest) document() (string, string) {
+	return r.LanguageId, r.TextDocument.URI
+}
+
+func (r documentRequest) validate() []fieldError {
+	if len(r.TextDocument.URI) == 0 {
+		return []fieldError{{"textDocument.uri", "must not be empty"}}
+	}
+
+	return nil
+}
+
+type positionRequest struct {
+	documentRequest
+	Position lsp.Position `json:"position,required"`
+	// Context is passed to the server, completion uses it for the trigger kind.
+	Context json.RawMessage `json:"context,omitempty"`
+}
+
+type referencesRequest struct {
+	positionRequest
+	// IncludeDeclaration is used when no context is given, it defaults to true.
+	IncludeDeclaration *bool `json:"includeDeclaration,omitempty"`
+}
+
+type renameRequest struct {
+	positionRequest
+	NewName string `json:"newName,required"`
+	// Apply writes the edits of documents that are not open to disk.
+	Apply bool `json:"apply,omitempty"`
+}
+
+func (r renameRequest) validate() []fieldError {
+	errs := r.positionRequest.validate()
+	if len(r.NewName) == 0 {
+		errs = append(errs, fieldError{"newName", "must not be empty"})
+	}
+
+	return errs
+}
+
+type formatRequest struct {
+	documentRequest
+	// Range is required by formatRange.
+	Range        *lsp.Range `json:"range,omitempty"`
+	Options      KeyValue   `json:"options,omitempty"`
+	TabSize      int        `json:"tabSize,omitempty"`
+	InsertSpaces *bool      `json:"insertSpaces,omitempty"`
+	// Text of the document, the formatted text is returned when set.
+	Text *string `json:"text,omitempty"`
+}
+
+type documentSymbolsRequest struct {
+	documentRequest
+	Flat bool `json:"flat,omitempty"`
+}
+
+type workspaceSymbolRequest struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+// diagnosticsRequest selects a document by uri or a workspace by name, the
+// diagnostics of all documents are returned otherwise.
+type diagnosticsRequest struct {
+	URI        string `json:"uri,omitempty"`
+	LanguageId string `json:"languageId,omitempty"`
+	Workspace  string `json:"workspace,omitempty"`
+}
+
+// workspaceDiagnosticsRequest selects a workspace by name, the current
+// workspace is used otherwise.
+type workspaceDiagnosticsRequest struct {
+	Workspace string `json:"workspace,omitempty"`
+	// Open opens every file of the workspace a server handles, most servers
+	// only report diagnostics of open documents.
+	Open bool `json:"open,omitempty"`
+	// Settle is how many seconds no diagnostics have to arrive before the
+	// report is taken, it defaults to 2.
+	Settle float64 `json:"settle,omitempty"`
+}
+
+type codeActionRequest struct {
+	documentRequest
+	Range lsp.Range `json:"range,required"`
+	// Context defaults to the diagnostics published for the range.
+	Context json.RawMessage `json:"context,omitempty"`
+}
+
+type executeCodeActionRequest struct {
+	TextDocument *textDocumentParam `json:"textDocument,omitempty"`
+	LanguageId   string             `json:"languageId,omitempty"`
+	// Action is a code action or command returned by codeAction.
+	Action json.RawMessage `json:"action,required"`
+	Apply  bool            `json:"apply,omitempty"`
+}
+
+func (r executeCodeActionRequest) document() (string, string) {
+	if r.TextDocument == nil {
+		return r.LanguageId, ""
+	}
+
+	return r.LanguageId, r.TextDocument.URI
+}
+
+func (r executeCodeActionRequest) validate() []fieldError {
+	if languageId, uri := r.document(); len(languageId) == 0 && len(uri) == 0 {
+		return []fieldError{{"languageId", "languageId or textDocument.uri is required"}}
+	}
+
+	return nil
+}
+
+type workspaceFolderParam struct {
+	URI  string `json:"uri"`
+	Name string `json:"name"`
+}
+
+type initializeRequest struct {
+	Dir        string                 `json:"dir,required"`
+	Name       string                 `json:"name,omitempty"`
+	LanguageId string                 `json:"languageId,omitempty"`
+	Folders    []workspaceFolderParam `json:"folders,omitempty"`
+	// Storage and License override the intelephense config.
+	Storage string `json:"storage,omitempty"`
+	License string `json:"license,omitempty"`
+}
+
+func (r initializeRequest) validate() []fieldError {
+	if len(r.Dir) == 0 {
+		return []fieldError{{"dir", "must not be empty"}}
+	}
+
+	return nil
+}
+
+type didOpenRequest struct {
+	URI        string `json:"uri,required"`
+	LanguageId string `json:"languageId"`
+	Version    int    `json:"version"`
+	Text       string `json:"text"`
+	// UUID identifies the TextMate document diagnostics are shown in.
+	UUID string `json:"uuid,omitempty"`
+}
+
+func (r didOpenRequest) validate() []fieldError {
+	if len(r.URI) == 0 {
+		return []fieldError{{"uri", "must not be empty"}}
+	}
+
+	return nil
+}
+
+func (r didChangeRequest) validate() []fieldError {
+	var errs []fieldError
+	if len(r.URI) == 0 {
+		errs = append(errs, fieldError{"uri", "must not be empty"})
+	}
+	if r.Text == nil && len(r.Changes) == 0 {
+		errs = append(errs, fieldError{"changes", "text or changes is required"})
+	}
+
+	return errs
+}
+
+type didCloseRequest struct {
+	URI        string `json:"uri,required"`
+	LanguageId string `json:"languageId,omitempty"`
+}
+
+func (r didCloseRequest) validate() []fieldError {
+	if len(r.URI) == 0 {
+		return []fieldError{{"uri", "must not be empty"}}
+	}
+
+	return nil
+}
+
+type copilotCompletionRequest struct {
+	// URI is a file uri or an absolute path, like the uri of all Copilot requests.
+	URI        string       `json:"uri,required"`
+	LanguageId string       `json:"languageId"`
+	Text       string       `json:"text"`
+	Position   lsp.Position `json:"position,required"`
+	TabSize    int          `json:"tabSize,omitempty"`
+	// Version defaults to the version of the open document.
+	Version *int `json:"version,omitempty"`
+}
+
+func (r copilotCompletionRequest) validate() []fieldError {
+	if _, err := documentURI(r.URI); err != nil {
+		return []fieldError{{"uri", err.Error()}}
+	}
+
+	return nil
+}
+
+// doc is the document of the Copilot getCompletions and getPanelCompletions requests.
+func (r copilotCompletionRequest) doc() KeyValue {
+	tabSize := r.TabSize
+	if tabSize == 0 {
+		tabSize = 4
+	}
+	version := 0
+	if r.Version != nil {
+		version = *r.Version
+	}
+	uri, _ := documentURI(r.URI)
+	path := uri.AsPath().String()
+
+	return KeyValue{
+		"source":       r.Text,
+		"tabSize":      tabSize,
+		"indentSize":   4,
+		"insertSpaces": true,
+		"version":      version,
+		"path":         path,
+		"uri":          uri,
+		"relativePath": filepath.Base(path),
+		"languageId":   r.LanguageId,
+		"position":     r.Position,
+	}
+}
+
+// inlineCompletionRequest asks Copilot for suggestions in an open document.
+type inlineCompletionRequest struct {
+	// URI is a file uri or an absolute path.
+	URI      string       `json:"uri,required"`
+	Position lsp.Position `json:"position,required"`
+	// Version defaults to the version of the open document.
+	Version      *int  `json:"version,omitempty"`
+	TabSize      int   `json:"tabSize,omitempty"`
+	InsertSpaces *bool `json:"insertSpaces,omitempty"`
+	// TriggerKind is 1 when invoked explicitly and 2 while typing, the default.
+	TriggerKind int `json:"triggerKind,omitempty"`
+}
+
+func (r inlineCompletionRequest) validate() []fieldError {
+	if _, err := documentURI(r.URI); err != nil {
+		return []fieldError{{"uri", err.Error()}}
+	}
+
+	return nil
+}
+
+// suggestionRequest selects the Copilot suggestion session of a document,
+// the latest session is used without uri. A session requested at another
+// position has expired.
+type suggestionRequest struct {
+	// URI is a file uri or an absolute path.
+	URI      string        `json:"uri,omitempty"`
+	Position *lsp.Position `json:"position,omitempty"`
+	// Partial accepts the next "word" or "line" of the suggestion only.
+	Partial string `json:"partial,omitempty"`
+}
+
+func (r suggestionRequest) validate() []fieldError {
+	if len(r.Partial) != 0 && r.Partial != "word" && r.Partial != "line" {
+		return []fieldError{{"partial", "must be word or line"}}
+	}
+
+	return nil
+}
+
+// completionAcceptedRequest reports a suggestion the IDE inserted, the shown
+// suggestion of the session is used without uuid.
+type completionAcceptedRequest struct {
+	UUID string `json:"uuid,omitempty"`
+	URI  string `json:"uri,omitempty"`
+	// AcceptedLength is the accepted part of the suggestion text in UTF-16
+	// code units, the whole suggestion is accepted without it.
+	AcceptedLength *int `json:"acceptedLength,omitempty"`
+}
+
+// completionRejectedRequest reports suggestions that were not used, the
+// suggestions shown in the session are used without uuids.
+type completionRejectedRequest struct {
+	UUIDs []string `json:"uuids,omitempty"`
+	URI   string   `json:"uri,omitempty"`
+}
+
+// copilotChatRequest asks Copilot chat about the code, partial replies are
+// streamed as copilotChat events.
+type copilotChatRequest struct {
+	Message string `json:"message,required"`
+	// ConversationID continues a conversation, a new one is started otherwise.
+	ConversationID string `json:"conversationId,omitempty"`
+	// URI and Selection refer to the current file and the selected code, URI
+	// is a file uri or an absolute path.
+	URI       string     `json:"uri,omitempty"`
+	Selection *lsp.Range `json:"selection,omitempty"`
+}
+
+func (r copilotChatRequest) validate() []fieldError {
+	if len(strings.TrimSpace(r.Message)) == 0 {
+		return []fieldError{{"message", "must not be empty"}}
+	}
+
+	return nil
+}
+
+type signInConfirmRequest struct {
+	UserCode string `json:"userCode,required"`
+}
+
+func (r signInConfirmRequest) validate() []fieldError {
+	if len(r.UserCode) == 0 {
+		return []fieldError{{"userCode", "must not be empty"}}
+	}
+
+	return nil
+}
+
+type emptyRequest struct{}
+
+// fieldError is a validation error of a request field.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type validator interface {
+	validate() []fieldError
+}
+
+var requiredFieldError = regexp.MustCompile(`^json: undefined required field (\S+) into`)
+
+// decodeRequest decodes and validates the body of an IDE request, it returns
+// a bad_request result on failure.
+func decodeRequest(body json.RawMessage, v interface{}) *KeyValue {
+	if len(body) == 0 {
+		body = json.RawMessage("{}")
+	}
+	var errs []fieldError
+	err := json.Unmarshal(body, v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && strings.HasPrefix(typeErr.Value, "number") {
+		// some editors send integers as floats, e.g. "version": 3.0
+		if integral, ok := integralNumbers(body); ok {
+			err = json.Unmarshal(integral, v)
+		}
+	}
+	if err != nil {
+		if errors.As(err, &typeErr) && len(typeErr.Field) != 0 {
+			errs = append(errs, fieldError{typeErr.Field, fmt.Sprintf("must be %s, got %s", typeErr.Type, typeErr.Value)})
+		} else if m := requiredFieldError.FindStringSubmatch(err.Error()); m != nil {
+			errs = append(errs, fieldError{m[1], "is required"})
+		} else {
+			return badRequest(err)
+		}
+	} else if r, ok := v.(validator); ok {
+		errs = r.validate()
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return decodeError(errs...)
+}
+
+// integralNumbers rewrites the numbers of body without fraction as integers.
+func integralNumbers(body json.RawMessage) (json.RawMessage, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, false
+	}
+	var rewrite func(v interface{}) interface{}
+	rewrite = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, item := range v {
+				v[k] = rewrite(item)
+			}
+		case []interface{}:
+			for i, item := range v {
+				v[i] = rewrite(item)
+			}
+		case json.Number:
+			if f, err := v.Float64(); err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+				return int64(f)
+			}
+		}
+		return v
+	}
+	result, err := json.Marshal(rewrite(value))
+
+	return result, err == nil
+}
+
+// decodeError is the bad_request result for invalid fields.
+func decodeError(errs ...fieldError) *KeyValue {
+	return &KeyValue{"status": "error", "error": apiError{
+		Code:    errBadRequest,
+		Message: fmt.Sprintf("invalid %s: %s", errs[0].Field, errs[0].Message),
+		Fields:  errs,
+	}}
+}
+
+// Responses of the IDE API, they describe the results in the API description.
+
+type okResponse struct {
+	Status string `json:"status"`
+}
+
+type rawResponse struct {
+	Status string          `json:"status"`
+	Result json.RawMessage `json:"result"`
+}
+
+type hoverResponse struct {
+	Status string     `json:"status"`
+	Result *lsp.Hover `json:"result"`
+}
+
+type locationsResponse struct {
+	Status string     `json:"status"`
+	Result []location `json:"result"`
+}
+
+type formatResponse struct {
+	Status string         `json:"status"`
+	Result []lsp.TextEdit `json:"result"`
+	Text   *string        `json:"text,omitempty"`
+}
+
+type signatureHelpResponse struct {
+	Status string         `json:"status"`
+	Result *signatureHelp `json:"result"`
+}
+
+type documentSymbolsResponse struct {
+	Status string           `json:"status"`
+	Result []documentSymbol `json:"result"`
+}
+
+type workspaceSymbolResponse struct {
+	Status string            `json:"status"`
+	Result []workspaceSymbol `json:"result"`
+}
+
+type diagnosticsResponse struct {
+	Status string            `json:"status"`
+	Result []fileDiagnostics `json:"result"`
+}
+
+// editsResponse is returned by rename and executeCodeAction, result holds the
+// edits unless apply is set, then applied and reload are returned.
+type editsResponse struct {
+	Status  string          `json:"status"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Applied []string        `json:"applied,omitempty"`
+	Reload  []fileEdits     `json:"reload,omitempty"`
+}
+
+type initializeResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type didChangeResponse struct {
+	Status  string `json:"status"`
+	Version int    `json:"version"`
+}
+
+type serverStatusResponse struct {
+	Status  string         `json:"status"`
+	Servers []serverStatus `json:"servers"`
+}
+
+// copilotResponse has the display text of the shown suggestion as result.
+type copilotResponse struct {
+	Status      string       `json:"status"`
+	Result      string       `json:"result,omitempty"`
+	Completions []Completion `json:"completions,omitempty"`
+	Suggestion  *suggestion  `json:"suggestion,omitempty"`
+}
+
+type panelCompletionsResponse struct {
+	Status string          `json:"status"`
+	Result []panelSolution `json:"result"`
+}
+
+// copilotChatResponse has the reply of the turn, done is false if the reply
+// did not end in time.
+type copilotChatResponse struct {
+	Status         string `json:"status"`
+	Result         string `json:"result"`
+	Done           bool   `json:"done"`
+	ConversationID string `json:"conversationId"`
+	TurnID         string `json:"turnId"`
+}
+
+type signInResponseBody struct {
+	Status          string `json:"status"`
+	User            string `json:"user,omitempty"`
+	Message         string `json:"message,omitempty"`
+	UserCode        string `json:"userCode,omitempty"`
+	VerificationUri string `json:"verificationUri,omitempty"`
+	ExpiresIn       int    `json:"expiresIn,omitempty"`
+	Interval        int    `json:"interval,omitempty"`
+}
+
+type errorResponse struct {
+	Status string   `json:"status"`
+	Error  apiError `json:"error"`
+}
+
+// apiMethod describes a method of the IDE API.
+type apiMethod struct {
+	Name        string
+	Description string
+	Request     interface{}
+	Response    interface{}
+}
+
+var apiMethods = []apiMethod{
+	{"initialize", "Opens a workspace in all language servers", initializeRequest{}, initializeResponse{}},
+	{"serverStatus", "Reports the state of the language servers", emptyRequest{}, serverStatusResponse{}},
+	{"describe", "Returns this description of the API", emptyRequest{}, nil},
+	{"didOpen", "Opens a document", didOpenRequest{}, okResponse{}},
+	{"didChange", "Syncs changes of an open document", didChangeRequest{}, didChangeResponse{}},
+	{"didClose", "Closes a document", didCloseRequest{}, okResponse{}},
+	{"hover", "Hover information at a position", positionRequest{}, hoverResponse{}},
+	{"completion", "Completions at a position", positionRequest{}, rawResponse{}},
+	{"definition", "Definition of the symbol at a position", positionRequest{}, rawResponse{}},
+	{"references", "References of the symbol at a position", referencesRequest{}, locationsResponse{}},
+	{"implementation", "Implementations of the symbol at a position", positionRequest{}, locationsResponse{}},
+	{"typeDefinition", "Type definition of the symbol at a position", positionRequest{}, locationsResponse{}},
+	{"declaration", "Declaration of the symbol at a position", positionRequest{}, locationsResponse{}},
+	{"signatureHelp", "Signature of the call at a position", positionRequest{}, signatureHelpResponse{}},
+	{"format", "Formats a document", formatRequest{}, formatResponse{}},
+	{"formatRange", "Formats a range of a document", formatRequest{}, formatResponse{}},
+	{"documentSymbols", "Outline of a document", documentSymbolsRequest{}, documentSymbolsResponse{}},
+	{"workspaceSymbol", "Searches symbols in all language servers", workspaceSymbolRequest{}, workspaceSymbolResponse{}},
+	{"diagnostics", "Diagnostics of a document, a workspace or all documents", diagnosticsRequest{}, diagnosticsResponse{}},
+	{"workspaceDiagnostics", "Diagnostics of all files of a workspace", workspaceDiagnosticsRequest{}, diagnosticsResponse{}},
+	{"codeAction", "Code actions for a range", codeActionRequest{}, rawResponse{}},
+	{"executeCodeAction", "Runs a code action", executeCodeActionRequest{}, editsResponse{}},
+	{"prepareRename", "Checks that the symbol at a position can be renamed", positionRequest{}, rawResponse{}},
+	{"rename", "Renames the symbol at a position", renameRequest{}, editsResponse{}},
+	{"getCompletions", "Copilot completion at a position", copilotCompletionRequest{}, copilotResponse{}},
+	{"getPanelCompletions", "Alternative Copilot solutions at a position, best first", copilotCompletionRequest{}, panelCompletionsResponse{}},
+	{"inlineCompletion", "Copilot inline completions at a position of an open document", inlineCompletionRequest{}, copilotResponse{}},
+	{"getCompletionsCycling", "Alias of nextCompletion", suggestionRequest{}, copilotResponse{}},
+	{"nextCompletion", "Shows the next Copilot suggestion of a session", suggestionRequest{}, copilotResponse{}},
+	{"previousCompletion", "Shows the previous Copilot suggestion of a session", suggestionRequest{}, copilotResponse{}},
+	{"acceptCompletion", "Accepts the shown Copilot suggestion, or its next word or line", suggestionRequest{}, copilotResponse{}},
+	{"dismissCompletion", "Ends a Copilot suggestion session without accepting", suggestionRequest{}, copilotResponse{}},
+	{"notifyCompletionAccepted", "Tells Copilot the completion was accepted", completionAcceptedRequest{}, okResponse{}},
+	{"notifyCompletionRejected", "Tells Copilot the completion was rejected", completionRejectedRequest{}, okResponse{}},
+	{"copilotChat", "Asks Copilot chat a question about the current file", copilotChatRequest{}, copilotChatResponse{}},
+	{"signIn", "Starts the Copilot sign in", emptyRequest{}, signInResponseBody{}},
+	{"signInConfirm", "Confirms the Copilot sign in", signInConfirmRequest{}, signInResponseBody{}},
+	{"checkStatus", "Copilot sign in status", emptyRequest{}, signInResponseBody{}},
+	{"authStatus", "Alias of checkStatus", emptyRequest{}, signInResponseBody{}},
+}
+
+// describeAPI returns a JSON Schema description of every method, requests
+// are sent as {"method": name, "body": request}.
+func describeAPI() KeyValue {
+	b := newSchemaBuilder()
+	methods := []KeyValue{}
+	for _, m := range apiMethods {
+		method := KeyValue{
+			"name":        m.Name,
+			"description": m.Description,
+			"request":     b.schemaOf(m.Request),
+		}
+		if m.Response != nil {
+			method["response"] = b.schemaOf(m.Response)
+		}
+		methods = append(methods, method)
+	}
+
+	return KeyValue{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"methods": methods,
+		"error":   b.schemaOf(errorResponse{}),
+		"$defs":   b.defs,
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"go.bug.st/json"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		version int
+		field   string
+	}{
+		{"int", `{"uri":"/a.go","version":3,"text":"x"}`, 3, ""},
+		{"integral float", `{"uri":"/a.go","version":3.0,"changes":[{"range":{"start":{"line":1.0,"character":0},"end":{"line":1,"character":2e0}},"text":"x"}]}`, 3, ""},
+		{"fraction", `{"uri":"/a.go","version":3.5,"text":"x"}`, 0, "version"},
+		{"string", `{"uri":"/a.go","version":"3","text":"x"}`, 0, "version"},
+		{"missing uri", `{"version":3,"text":"x"}`, 0, "uri"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := didChangeRequest{}
+			result := decodeRequest(json.RawMessage(tt.body), &params)
+			if len(tt.field) != 0 {
+				e, ok := resultError(result)
+				if !ok || len(e.Fields) == 0 || e.Fields[0].Field != tt.field {
+					t.Fatalf("expected an error for %s, got %v", tt.field, result)
+				}
+				return
+			}
+			if result != nil {
+				t.Fatalf("unexpected error %v", *result)
+			}
+			if params.Version == nil || *params.Version != tt.version {
+				t.Errorf("version %v, want %d", params.Version, tt.version)
+			}
+		})
+	}
+}
+
+func TestSchema(t *testing.T) {
+	b := newSchemaBuilder()
+	schema := b.schemaOf(positionRequest{})
+	if schema["$ref"] != "#/$defs/positionRequest" {
+		t.Fatalf("unexpected schema %v", schema)
+	}
+	request := b.defs["positionRequest"]
+	properties := request["properties"].(KeyValue)
+	// the embedded documentRequest is inlined
+	for _, name := range []string{"textDocument", "languageId", "position", "context"} {
+		if _, ok := properties[name]; !ok {
+			t.Errorf("property %s missing in %v", name, properties)
+		}
+	}
+	required, _ := request["required"].([]string)
+	if len(required) != 2 || required[0] != "textDocument" || required[1] != "position" {
+		t.Errorf("required %v", required)
+	}
+	if len(properties["context"].(KeyValue)) != 0 {
+		t.Errorf("raw context has schema %v", properties["context"])
+	}
+	line := b.defs["Position"]["properties"].(KeyValue)["line"]
+	if line.(KeyValue)["type"] != "integer" {
+		t.Errorf("line has schema %v", line)
+	}
+
+	api := describeAPI()
+	if len(api["methods"].([]KeyValue)) != len(apiMethods) {
+		t.Errorf("methods missing in the API description")
+	}
+	if _, err := json.Marshal(api); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tectiv3/go-lsp"
+	"go.bug.st/json"
+)
+
+// chatTurn collects the reply Copilot streams as $/progress for a turn.
+type chatTurn struct {
+	uri   string
+	reply strings.Builder
+	// conversationID and turnID are reported with the progress
+	conversationID string
+	turnID         string
+	// done is closed by the end progress, err is set if the turn failed
+	done chan struct{}
+	err  error
+}
+
+var chats = struct {
+	byToken map[string]*chatTurn
+	nextID  int
+	sync.Mutex
+}{byToken: map[string]*chatTurn{}}
+
+// chatProgress is the value of the $/progress of a conversation turn.
+type chatProgress struct {
+	Kind           string `json:"kind"`
+	ConversationID string `json:"conversationId"`
+	TurnID         string `json:"turnId"`
+	Reply          string `json:"reply"`
+	Error          *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// copilotChat sends a message to a new or an existing conversation, partial
+// replies are published as copilotChat events. The reply is returned once the
+// turn ended, or as far as it arrived when ctx ends.
+func (c *handler) copilotChat(ctx context.Context, params copilotChatRequest) *KeyValue {
+	turn := &chatTurn{uri: params.URI, conversationID: params.ConversationID, done: make(chan struct{})}
+	chats.Lock()
+	chats.nextID++
+	token := fmt.Sprintf("copilot-chat-%d", chats.nextID)
+	chats.byToken[token] = turn
+	chats.Unlock()
+	defer func() {
+		chats.Lock()
+		delete(chats.byToken, token)
+		chats.Unlock()
+	}()
+
+	request := KeyValue{"workDoneToken": token, "source": "panel"}
+	if len(params.URI) != 0 {
+		uri, err := documentURI(params.URI)
+		if err != nil {
+			return decodeError(fieldError{"uri", err.Error()})
+		}
+		reference := KeyValue{"type": "file", "uri": uri, "status": "included"}
+		if params.Selection != nil {
+			reference["selection"] = params.Selection
+		}
+		request["references"] = []KeyValue{reference}
+		request["textDocument"] = KeyValue{"uri": uri}
+	}
+	method := "conversation/turn"
+	if len(params.ConversationID) == 0 {
+		method = "conversation/create"
+		request["turns"] = []KeyValue{{"request": params.Message}}
+		request["capabilities"] = KeyValue{"skills": []string{}, "allSkills": false}
+	} else {
+		request["conversationId"] = params.ConversationID
+		request["message"] = params.Message
+	}
+
+	ctx, cancel := replyContext(ctx)
+	defer cancel()
+	response, respErr, err := c.lsc.GetConnection().SendRequest(ctx, method, lsp.EncodeMessage(request))
+	if respErr != nil || err != nil {
+		return backendError(ctx, respErr, err)
+	}
+	ids := struct {
+		ConversationID string `json:"conversationId"`
+		TurnID         string `json:"turnId"`
+	}{}
+	json.Unmarshal(response, &ids)
+
+	done := true
+	select {
+	case <-turn.done:
+	case <-ctx.Done():
+		done = false
+	}
+
+	chats.Lock()
+	defer chats.Unlock()
+	if turn.err != nil {
+		return errorResult(errBackendError, "%s", turn.err)
+	}
+	if len(ids.ConversationID) == 0 {
+		ids.ConversationID = turn.conversationID
+	}
+	if len(ids.TurnID) == 0 {
+		ids.TurnID = turn.turnID
+	}
+
+	return &KeyValue{
+		"status": "ok", "result": turn.reply.String(), "done": done,
+		"conversationId": ids.ConversationID, "turnId": ids.TurnID,
+	}
+}
+
+// onChatProgress handles the progress of a conversation turn, it returns false
+// for other progress.
+func onChatProgress(params *lsp.ProgressParams) bool {
+	var token string
+	if err := json.Unmarshal(params.Token, &token); err != nil {
+		return false
+	}
+	chats.Lock()
+	defer chats.Unlock()
+	turn, ok := chats.byToken[token]
+	if !ok {
+		return false
+	}
+
+	progress := chatProgress{}
+	if err := json.Unmarshal(params.Value, &progress); err != nil {
+		LogError(err)
+		return true
+	}
+	if len(progress.ConversationID) != 0 {
+		turn.conversationID = progress.ConversationID
+	}
+	if len(progress.TurnID) != 0 {
+		turn.turnID = progress.TurnID
+	}
+	if len(progress.Reply) != 0 {
+		turn.reply.WriteString(progress.Reply)
+		events.publish(event{Type: eventCopilotChat, Server: "copilot", URI: turn.uri, Data: KeyValue{
+			"conversationId": turn.conversationID,
+			"turnId":         turn.turnID,
+			"reply":          progress.Reply,
+		}})
+	}
+	if progress.Kind == "end" {
+		if progress.Error != nil {
+			turn.err = fmt.Errorf("chat failed: %s", progress.Error.Message)
+		}
+		select {
+		case <-turn.done:
+		default:
+			close(turn.done)
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tectiv3/go-lsp"
+	"go.bug.st/json"
+)
+
+// codeAction is a CodeAction, or a bare Command when Command holds the command name.
+type codeAction struct {
+	Title   string          `json:"title"`
+	Kind    string          `json:"kind,omitempty"`
+	Edit    *workspaceEdit  `json:"edit,omitempty"`
+	Command json.RawMessage `json:"command,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type command struct {
+	Title     string            `json:"title"`
+	Command   string            `json:"command"`
+	Arguments []json.RawMessage `json:"arguments,omitempty"`
+}
+
+// executeCodeAction resolves the action if needed, runs its command and returns
+// the edits of the action together with the edits the server applied while
+// running the command.
+func (h *handler) executeCodeAction(ctx context.Context, raw json.RawMessage) ([]workspaceEdit, error) {
+	action := codeAction{}
+	if err := json.Unmarshal(raw, &action); err != nil {
+		return nil, err
+	}
+	if len(action.Command) > 0 && action.Command[0] == '"' {
+		return h.executeCommand(ctx, raw)
+	}
+
+	conn := h.lsc.GetConnection()
+	if action.Edit == nil && len(action.Command) == 0 && len(action.Data) > 0 {
+		resp, respErr, err := conn.SendRequest(ctx, "codeAction/resolve", raw)
+		if err != nil {
+			return nil, err
+		}
+		if respErr != nil {
+			return nil, respErr.AsError()
+		}
+		action = codeAction{}
+		if err := json.Unmarshal(resp, &action); err != nil {
+			return nil, err
+		}
+	}
+
+	edits := []workspaceEdit{}
+	if action.Edit != nil {
+		edits = append(edits, *action.Edit)
+	}
+	if len(action.Command) > 0 {
+		applied, err := h.executeCommand(ctx, action.Command)
+		if err != nil {
+			return nil, err
+		}
+		edits = append(edits, applied...)
+	}
+
+	return edits, nil
+}
+
+// executeCommand runs workspace/executeCommand and collects the edits the
+// server sends with workspace/applyEdit in the meantime.
+func (h *handler) executeCommand(ctx context.Context, raw json.RawMessage) ([]workspaceEdit, error) {
+	cmd := command{}
+	if err := json.Unmarshal(raw, &cmd); err != nil {
+		return nil, err
+	}
+	if len(cmd.Command) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+
+	h.commandMu.Lock()
+	defer h.commandMu.Unlock()
+	edits := []workspaceEdit{}
+	h.Lock()
+	h.collector = &edits
+	h.Unlock()
+
+	_, respErr, err := h.lsc.GetConnection().SendRequest(ctx, "workspace/executeCommand", lsp.EncodeMessage(KeyValue{
+		"command":   cmd.Command,
+		"arguments": cmd.Arguments,
+	}))
+
+	h.Lock()
+	h.collector = nil
+	h.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	if respErr != nil {
+		return nil, respErr.AsError()
+	}
+
+	return edits, nil
+}
+
+// diagnosticsIn returns the last published diagnostics of uri that overlap r.
+func (h *handler) diagnosticsIn(uri string, r lsp.Range) []lsp.Diagnostic {
+	result := []lsp.Diagnostic{}
+	docURI, err := lsp.NewDocumentURIFromURL(uri)
+	if err != nil {
+		return result
+	}
+
+	published, _ := store.get(docURI.String(), h.name)
+	for _, d := range published.Diagnostics {
+		if !positionBefore(d.Range.End, r.Start) && !positionBefore(r.End, d.Range.Start) {
+			result = append(result, d)
+		}
+	}
+
+	return result
+}
+
+func positionBefore(a, b lsp.Position) bool {
+	return a.Line < b.Line || (a.Line == b.Line && a.Character < b.Character)
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"path/filepath"
 	"time"
 
 	"github.com/tectiv3/go-lsp"
@@ -12,24 +11,30 @@ import (
 	"go.bug.st/json"
 )
 
-var (
-	cClient             *handler
-	lastCompletionItems []Completion
-	lastCompletionIndex int
-)
+var cClient *handler
 
-func startCopilot(in mrChan) {
-	cClient = startRPCServer("copilot", config.NodePath, config.CopilotPath, "--stdio")
+// startCopilot starts the Copilot language server, with terminalAuth set it
+// signs in on the terminal if needed. An editor on stdio owns the terminal, the
+// IDE signs in through the API then.
+func startCopilot(in mrChan, terminalAuth bool) {
+	var err error
+	cClient, err = startRPCServer("copilot", config.NodePath, config.CopilotPath, "--stdio")
+	if err != nil {
+		panic(err)
+	}
 
 	cClient.Requests = make(map[string]string)
 	cClient.lsc.SetLogger(&Logger{
 		IncomingPrefix: "LSC <-- Copilot", OutgoingPrefix: "LSC --> Copilot",
 		HiColor: hiGreenString, LoColor: greenString, ErrorColor: errorString,
 	})
+	cClient.lsc.RegisterCustomNotification("PanelSolution", onPanelSolution)
+	cClient.lsc.RegisterCustomNotification("PanelSolutionsDone", onPanelSolutionsDone)
 	cClient.lsc.RegisterCustomNotification("statusNotification", func(logger jsonrpc.FunctionLogger, params json.RawMessage) {
 		if config.EnableLogging {
 			logger.Logf("%s", string(params))
 		}
+		events.publish(event{Type: eventCopilotStatus, Server: "copilot", Data: params})
 	})
 
 	go cClient.lsc.Run()
@@ -39,7 +44,11 @@ func startCopilot(in mrChan) {
 
 	// Perform authentication check and terminal login if needed
 	auth := NewTerminalAuth(cClient)
-	if err := auth.PerformAuthWithRetry(3); err != nil {
+	if !terminalAuth {
+		if !auth.IsAuthenticated() {
+			Log("Copilot is not signed in, sign in with the signIn API")
+		}
+	} else if err := auth.PerformAuthWithRetry(3); err != nil {
 		LogError(fmt.Errorf("Copilot authentication failed: %w", err))
 		fmt.Printf("\n" + hiRedString("Warning: Copilot authentication failed. You can try again later using the API.") + "\n\n")
 	}
@@ -52,7 +61,6 @@ func (c *handler) processCopilotRequests(in mrChan) {
 		c.processCopilotRequests(in)
 	})
 	Log("Copilot is waiting for input")
-	ctx := context.Background()
 	lsc := c.lsc
 	conn := lsc.GetConnection()
 	for {
@@ -60,6 +68,7 @@ func (c *handler) processCopilotRequests(in mrChan) {
 		if config.EnableLogging {
 			Log("LSC <-- IDE %s %s %db", "request", request.Method, len(string(request.Body)))
 		}
+		ctx := request.Context()
 
 		switch request.Method {
 		case "initialize":
@@ -74,7 +83,11 @@ func (c *handler) processCopilotRequests(in mrChan) {
 			}, conn, ctx)
 			request.CB <- &KeyValue{"status": "ok"}
 		case "signIn":
-			resp := sendRequest("signInInitiate", KeyValue{}, conn, ctx)
+			resp, failed := copilotRequest(ctx, conn, "signInInitiate", KeyValue{})
+			if failed != nil {
+				request.CB <- failed
+				continue
+			}
 			var res signInResponse
 			json.Unmarshal(resp, &res)
 			//        eval_in_emacs("browse-url", result['verificationUri'])
@@ -83,7 +96,7 @@ func (c *handler) processCopilotRequests(in mrChan) {
 			// If already signed in, return success
 			if res.Status == "AlreadySignedIn" {
 				request.CB <- &KeyValue{"status": "success", "user": res.User, "message": "Already signed in"}
-				return
+				continue
 			}
 
 			// Return the authentication details for the client to handle
@@ -97,72 +110,76 @@ func (c *handler) processCopilotRequests(in mrChan) {
 		case "signInConfirm":
 			textDocument := &KeyValue{}
 			if err := json.Unmarshal(request.Body, textDocument); err != nil {
-				request.CB <- &KeyValue{"status": "error", "message": err.Error()}
-				return
+				request.CB <- badRequest(err)
+				continue
 			}
 			userCode := textDocument.string("userCode", "")
 			if userCode == "" {
-				request.CB <- &KeyValue{"status": "error", "message": "userCode is required"}
-				return
+				request.CB <- errorResult(errBadRequest, "userCode is required")
+				continue
 			}
 
-			resp := sendRequest("signInConfirm", KeyValue{"userCode": userCode}, conn, ctx)
+			resp, failed := copilotRequest(ctx, conn, "signInConfirm", KeyValue{"userCode": userCode})
+			if failed != nil {
+				request.CB <- failed
+				continue
+			}
 			var res signInConfirmResponse
 			json.Unmarshal(resp, &res)
 
 			if res.Status == "NotAuthorized" {
-				request.CB <- &KeyValue{"status": "error", "message": "Not authorized"}
-				return
+				request.CB <- errorResult(errBackendError, "Not authorized")
+				continue
 			}
 
 			request.CB <- &KeyValue{"status": "success", "user": res.User}
 		case "checkStatus":
-			resp := sendRequest("checkStatus", KeyValue{}, conn, ctx)
+			resp, failed := copilotRequest(ctx, conn, "checkStatus", KeyValue{})
+			if failed != nil {
+				request.CB <- failed
+				continue
+			}
 			var res checkStatusResponse
 			json.Unmarshal(resp, &res)
 
 			if res.Status == "NotAuthorized" {
-				request.CB <- &KeyValue{"status": "error", "message": "Not authorized"}
-				return
+				request.CB <- errorResult(errBackendError, "Not authorized")
+				continue
 			}
 
 			request.CB <- &KeyValue{"status": "success", "user": res.User}
 		case "authStatus":
 			// Alias for checkStatus
-			resp := sendRequest("checkStatus", KeyValue{}, conn, ctx)
+			resp, failed := copilotRequest(ctx, conn, "checkStatus", KeyValue{})
+			if failed != nil {
+				request.CB <- failed
+				continue
+			}
 			var res checkStatusResponse
 			json.Unmarshal(resp, &res)
 
 			if res.Status == "NotAuthorized" {
-				request.CB <- &KeyValue{"status": "error", "message": "Not authorized"}
-				return
+				request.CB <- errorResult(errBackendError, "Not authorized")
+				continue
 			}
 
 			request.CB <- &KeyValue{"status": "success", "user": res.User}
 		case "getCompletions":
 			go func() {
-				lastCompletionItems = []Completion{}
-				textDocument := &KeyValue{}
-				if err := json.Unmarshal(request.Body, textDocument); err != nil {
-					request.CB <- &KeyValue{"result": "error", "message": err.Error()}
+				params := copilotCompletionRequest{}
+				if result := decodeRequest(request.Body, &params); result != nil {
+					request.CB <- result
+					return
+				}
+				version := 0
+				if params.Version != nil {
+					version = *params.Version
+				}
+				resp, failed := copilotRequest(ctx, conn, "getCompletions", KeyValue{"doc": params.doc()})
+				if failed != nil {
+					request.CB <- failed
 					return
 				}
-				path := textDocument.string("uri", "")
-				position := textDocument.keyValue("position", KeyValue{})
-				resp := sendRequest("getCompletions", KeyValue{
-					"doc": KeyValue{
-						"source":       textDocument.string("text", ""),
-						"tabSize":      textDocument.int("tabSize", 4),
-						"indentSize":   4,
-						"insertSpaces": true,
-						"version":      0,
-						"path":         path,
-						"uri":          "file://" + path,
-						"relativePath": filepath.Base(path),
-						"languageId":   textDocument.string("languageId", ""),
-						"position":     position,
-					},
-				}, conn, ctx)
 				if string(resp) == "null" {
 					Log("Empty response")
 					request.CB <- &KeyValue{"status": "ok", "result": "No completions"}
@@ -170,95 +187,305 @@ func (c *handler) processCopilotRequests(in mrChan) {
 				}
 				result := CompletionsResponse{}
 				if err := json.Unmarshal(resp, &result); err != nil {
-					request.CB <- &KeyValue{"result": "error", "message": err.Error()}
+					request.CB <- errorResult(errBackendError, "%s", err)
 					return
 				}
-				// check that slice of completions is not empty
-				if len(result.Completions) == 0 {
-					request.CB <- &KeyValue{"status": "ok", "result": "No completions"}
+				request.CB <- c.completionsResult(params.URI, params.Position, version, result.Completions)
+			}()
+		case "getPanelCompletions":
+			go func() {
+				params := copilotCompletionRequest{}
+				if result := decodeRequest(request.Body, &params); result != nil {
+					request.CB <- result
 					return
 				}
-				if len(result.Completions) > 1 {
-					Log("Last completion items: %d", len(result.Completions))
-					lastCompletionItems = result.Completions
-				}
-				lastCompletionIndex = 0
-				completion := result.Completions[lastCompletionIndex]
-				conn.SendNotification("notifyShown", lsp.EncodeMessage(KeyValue{
-					"uuids": []string{completion.UUID},
-				}))
-				request.CB <- &KeyValue{
-					"status": "ok", "result": lsp.EncodeMessage(completion.DisplayText),
+				request.CB <- c.panelCompletions(ctx, params)
+			}()
+		case "copilotChat":
+			go func() {
+				params := copilotChatRequest{}
+				if result := decodeRequest(request.Body, &params); result != nil {
+					request.CB <- result
+					return
 				}
+				request.CB <- c.copilotChat(ctx, params)
 			}()
-		case "getCompletionsCycling":
+		case "inlineCompletion":
 			go func() {
-				if len(lastCompletionItems) == 0 {
-					request.CB <- &KeyValue{"status": "ok", "result": "No completions"}
+				params := inlineCompletionRequest{}
+				if result := decodeRequest(request.Body, &params); result != nil {
+					request.CB <- result
 					return
 				}
-				if lastCompletionIndex+1 >= len(lastCompletionItems) {
-					lastCompletionIndex = 0
-				} else {
-					lastCompletionIndex++
+				uri, _ := documentURI(params.URI)
+				triggerKind := params.TriggerKind
+				if triggerKind == 0 {
+					triggerKind = inlineCompletionTriggerAutomatic
 				}
-				if lastCompletionIndex < 0 || lastCompletionIndex >= len(lastCompletionItems) {
-					request.CB <- &KeyValue{"status": "ok", "result": "No completions"}
-					return
+				tabSize := params.TabSize
+				if tabSize == 0 {
+					tabSize = 4
+				}
+				version := 0
+				if params.Version != nil {
+					version = *params.Version
 				}
-				completion := lastCompletionItems[lastCompletionIndex]
-				conn.SendNotification("notifyShown", lsp.EncodeMessage(KeyValue{
-					"uuids": []string{completion.UUID},
+				resp, respErr, err := conn.SendRequest(ctx, "textDocument/inlineCompletion", lsp.EncodeMessage(KeyValue{
+					"textDocument":      KeyValue{"uri": uri, "version": version},
+					"position":          params.Position,
+					"context":           KeyValue{"triggerKind": triggerKind},
+					"formattingOptions": KeyValue{"tabSize": tabSize, "insertSpaces": params.InsertSpaces == nil || *params.InsertSpaces},
 				}))
-				request.CB <- &KeyValue{
-					"status": "ok", "result": lsp.EncodeMessage(completion.DisplayText),
+				if respErr != nil || err != nil {
+					request.CB <- backendError(ctx, respErr, err)
+					return
+				}
+				result := inlineCompletionList{}
+				if string(resp) != "null" {
+					if err := json.Unmarshal(resp, &result); err != nil {
+						request.CB <- errorResult(errBackendError, "%s", err)
+						return
+					}
+				}
+				completions := []Completion{}
+				for _, item := range result.Items {
+					completions = append(completions, item.completion(params.Position, version))
 				}
+				request.CB <- c.completionsResult(params.URI, params.Position, version, completions)
 			}()
+		case "getCompletionsCycling", "nextCompletion", "previousCompletion":
+			params := suggestionRequest{}
+			if result := decodeRequest(request.Body, &params); result != nil {
+				request.CB <- result
+				continue
+			}
+			step := 1
+			if request.Method == "previousCompletion" {
+				step = -1
+			}
+			shown, rejected, ok := suggestions.move(params.URI, params.Position, step)
+			c.notifyRejected(rejected)
+			if !ok {
+				request.CB <- &KeyValue{"status": "ok", "result": "No completions"}
+				continue
+			}
+			conn.SendNotification("notifyShown", lsp.EncodeMessage(KeyValue{
+				"uuids": []string{shown.Completion.UUID},
+			}))
+			request.CB <- &KeyValue{
+				"status": "ok", "result": lsp.EncodeMessage(shown.Completion.DisplayText), "suggestion": shown,
+			}
+		case "acceptCompletion":
+			params := suggestionRequest{}
+			if result := decodeRequest(request.Body, &params); result != nil {
+				request.CB <- result
+				continue
+			}
+			if len(params.Partial) != 0 {
+				session, insert, acceptedLength, rejected, ok := suggestions.acceptPartial(params.URI, params.Position, params.Partial)
+				c.notifyRejected(rejected)
+				if !ok {
+					request.CB <- &KeyValue{"status": "ok", "result": "No completions"}
+					continue
+				}
+				shown := session.current()
+				c.notifyAccepted(shown.Completion.UUID, &acceptedLength)
+				request.CB <- &KeyValue{"status": "ok", "result": lsp.EncodeMessage(insert), "suggestion": shown}
+				continue
+			}
+			session, rejected, ok := suggestions.end(params.URI, params.Position)
+			c.notifyRejected(rejected)
+			if !ok {
+				request.CB <- &KeyValue{"status": "ok", "result": "No completions"}
+				continue
+			}
+			shown := session.current()
+			c.notifyAccepted(shown.Completion.UUID, nil)
+			request.CB <- &KeyValue{"status": "ok", "suggestion": shown}
+		case "dismissCompletion":
+			params := suggestionRequest{}
+			if result := decodeRequest(request.Body, &params); result != nil {
+				request.CB <- result
+				continue
+			}
+			session, rejected, ok := suggestions.end(params.URI, params.Position)
+			c.notifyRejected(rejected)
+			if !ok {
+				request.CB <- &KeyValue{"status": "ok", "result": "No completions"}
+				continue
+			}
+			c.notifyRejected(session.rejected())
+			request.CB <- &KeyValue{"status": "ok", "suggestion": session.current()}
 		case "notifyCompletionAccepted":
-			// Send notification to copilot server
-			conn.SendNotification("notifyAccepted", lsp.EncodeMessage(KeyValue{}))
+			// the IDE inserted the suggestion itself
+			params := completionAcceptedRequest{}
+			if result := decodeRequest(request.Body, &params); result != nil {
+				request.CB <- result
+				continue
+			}
+			uuid := params.UUID
+			if len(uuid) == 0 || len(params.URI) != 0 {
+				if session, _, ok := suggestions.end(params.URI, nil); ok && len(uuid) == 0 {
+					uuid = session.current().Completion.UUID
+				}
+			}
+			if len(uuid) == 0 {
+				request.CB <- decodeError(fieldError{"uuid", "no suggestion is shown"})
+				continue
+			}
+			c.notifyAccepted(uuid, params.AcceptedLength)
 			request.CB <- &KeyValue{"status": "ok"}
 		case "notifyCompletionRejected":
-			// Send notification to copilot server
-			conn.SendNotification("notifyRejected", lsp.EncodeMessage(KeyValue{}))
+			params := completionRejectedRequest{}
+			if result := decodeRequest(request.Body, &params); result != nil {
+				request.CB <- result
+				continue
+			}
+			uuids := params.UUIDs
+			if len(uuids) == 0 || len(params.URI) != 0 {
+				if session, _, ok := suggestions.end(params.URI, nil); ok && len(uuids) == 0 {
+					uuids = session.rejected()
+				}
+			}
+			c.notifyRejected(uuids)
 			request.CB <- &KeyValue{"status": "ok"}
 		case "textDocument/didOpen":
-			lastCompletionItems = []Completion{}
 			textDocument := &KeyValue{}
 			if err := json.Unmarshal(request.Body, textDocument); err != nil {
-				request.CB <- &KeyValue{"result": "error", "message": err.Error()}
-				return
+				request.CB <- badRequest(err)
+				continue
 			}
+			c.notifyRejected(suggestions.remove(textDocument.string("uri", "")))
 			uri, _ := lsp.NewDocumentURIFromURL(textDocument.string("uri", ""))
-			go lsc.TextDocumentDidOpen(&lsp.DidOpenTextDocumentParams{TextDocument: lsp.TextDocumentItem{
+			lsc.TextDocumentDidOpen(&lsp.DidOpenTextDocumentParams{TextDocument: lsp.TextDocumentItem{
 				URI:        uri,
 				LanguageID: textDocument.string("languageId", ""),
-				Version:    textDocument.int("version", 0),
+				Version:    int(textDocument.float64("version", 0)),
 				Text:       textDocument.string("text", ""),
 			}})
 			request.CB <- &KeyValue{"status": "ok"}
+		case "textDocument/didChange":
+			params := lsp.DidChangeTextDocumentParams{}
+			if err := json.Unmarshal(request.Body, &params); err != nil {
+				request.CB <- badRequest(err)
+				continue
+			}
+			c.notifyRejected(suggestions.expire(params.TextDocument.URI.String(), params.TextDocument.Version))
+			lsc.TextDocumentDidChange(&params)
+			request.CB <- &KeyValue{"status": "ok"}
 		case "textDocument/didClose":
-			lastCompletionItems = []Completion{}
 			textDocument := lsp.TextDocumentIdentifier{}
 			if err := json.Unmarshal(request.Body, &textDocument); err != nil {
-				request.CB <- &KeyValue{"result": "error", "message": err.Error()}
-				return
+				request.CB <- badRequest(err)
+				continue
 			}
-			go lsc.TextDocumentDidClose(&lsp.DidCloseTextDocumentParams{TextDocument: textDocument})
+			c.notifyRejected(suggestions.remove(textDocument.URI.String()))
+			lsc.TextDocumentDidClose(&lsp.DidCloseTextDocumentParams{TextDocument: textDocument})
 			request.CB <- &KeyValue{"status": "ok"}
 		}
 	}
 }
 
+// Trigger kinds of textDocument/inlineCompletion
+const (
+	inlineCompletionTriggerInvoked   = 1
+	inlineCompletionTriggerAutomatic = 2
+)
+
+// inlineCompletionList is the result of textDocument/inlineCompletion.
+type inlineCompletionList struct {
+	Items []inlineCompletionItem `json:"items"`
+}
+
+type inlineCompletionItem struct {
+	InsertText string     `json:"insertText"`
+	Range      *lsp.Range `json:"range,omitempty"`
+	// Command is run when the item is accepted, its argument is the uuid.
+	Command *lsp.Command `json:"command,omitempty"`
+}
+
+// completion converts the item to the suggestion format of getCompletions.
+func (item inlineCompletionItem) completion(position lsp.Position, version int) Completion {
+	completion := Completion{
+		Text:        item.InsertText,
+		DisplayText: item.InsertText,
+		Position:    position,
+		Range:       lsp.Range{Start: position, End: position},
+		DocVersion:  version,
+	}
+	if item.Range != nil {
+		completion.Range = *item.Range
+	}
+	if item.Command != nil && len(item.Command.Arguments) > 0 {
+		json.Unmarshal(item.Command.Arguments[0], &completion.UUID)
+	}
+
+	return completion
+}
+
+// completionsResult starts a suggestion session for the document, it returns
+// the first suggestion as result and all of them with their text, range and
+// uuid as completions.
+func (c *handler) completionsResult(uri string, position lsp.Position, version int, completions []Completion) *KeyValue {
+	if len(completions) == 0 {
+		c.notifyRejected(suggestions.remove(uri))
+		return &KeyValue{"status": "ok", "result": "No completions"}
+	}
+	shown, rejected := suggestions.start(uri, position, version, completions)
+	c.notifyRejected(rejected)
+	c.lsc.GetConnection().SendNotification("notifyShown", lsp.EncodeMessage(KeyValue{
+		"uuids": []string{shown.Completion.UUID},
+	}))
+
+	return &KeyValue{
+		"status": "ok", "result": lsp.EncodeMessage(shown.Completion.DisplayText),
+		"completions": completions, "suggestion": shown,
+	}
+}
+
+// notifyAccepted tells Copilot which suggestion was accepted, acceptedLength
+// is the accepted part of its text for partial accepts.
+func (c *handler) notifyAccepted(uuid string, acceptedLength *int) {
+	params := KeyValue{"uuid": uuid}
+	if acceptedLength != nil {
+		params["acceptedLength"] = *acceptedLength
+	}
+	go sendRequest("notifyAccepted", params, c.lsc.GetConnection(), context.Background())
+}
+
+// notifyRejected tells Copilot the shown suggestions were not used.
+func (c *handler) notifyRejected(uuids []string) {
+	if len(uuids) == 0 {
+		return
+	}
+	go sendRequest("notifyRejected", KeyValue{"uuids": uuids}, c.lsc.GetConnection(), context.Background())
+}
+
 func sendRequest(method string, request KeyValue, conn *jsonrpc.Connection, ctx context.Context) json.RawMessage {
-	return sendRequestWithAuth(method, request, conn, ctx, true)
+	resp, _, _ := sendRequestWithAuth(method, request, conn, ctx, true)
+	if resp == nil {
+		return []byte{}
+	}
+
+	return resp
+}
+
+// copilotRequest sends a request like sendRequest, a failed request returns
+// the error result of the IDE API instead of an empty response.
+func copilotRequest(ctx context.Context, conn *jsonrpc.Connection, method string, request KeyValue) (json.RawMessage, *KeyValue) {
+	resp, respErr, err := sendRequestWithAuth(method, request, conn, ctx, true)
+	if respErr != nil || err != nil {
+		return nil, backendError(ctx, respErr, err)
+	}
+
+	return resp, nil
 }
 
-func sendRequestWithAuth(method string, request KeyValue, conn *jsonrpc.Connection, ctx context.Context, allowReauth bool) json.RawMessage {
+func sendRequestWithAuth(method string, request KeyValue, conn *jsonrpc.Connection, ctx context.Context, allowReauth bool) (json.RawMessage, *jsonrpc.ResponseError, error) {
 	body, err := json.Marshal(request)
 	if err != nil {
 		LogError(err)
-		return []byte{}
+		return nil, nil, err
 	}
 
 	resp, respErr, err := conn.SendRequest(ctx, method, body)
@@ -271,7 +498,7 @@ func sendRequestWithAuth(method string, request KeyValue, conn *jsonrpc.Connecti
 			Log("Detected authentication error, attempting re-authentication...")
 			if err := handleReauthentication(conn, ctx); err != nil {
 				LogError(fmt.Errorf("re-authentication failed: %w", err))
-				return []byte{}
+				return nil, respErr, nil
 			}
 
 			// Retry the original request without allowing further re-authentication
@@ -279,10 +506,10 @@ func sendRequestWithAuth(method string, request KeyValue, conn *jsonrpc.Connecti
 			return sendRequestWithAuth(method, request, conn, ctx, false)
 		}
 
-		return []byte{}
+		return nil, respErr, err
 	}
 
-	return resp
+	return resp, nil, nil
 }
 
 // isAuthenticationError checks if the error is related to authentication
@@ -319,6 +546,11 @@ func handleReauthentication(conn *jsonrpc.Connection, ctx context.Context) error
 		return nil
 	}
 
+	// An editor on stdio owns the terminal, the IDE signs in through the API
+	if config.LSPListen == "stdio" {
+		return fmt.Errorf("not signed in, sign in with the signIn API")
+	}
+
 	// If still not authenticated, try the full auth flow
 	Log("Performing full re-authentication flow...")
 	if err := auth.PerformTerminalAuth(); err != nil {
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/tectiv3/go-lsp"
+)
+
+// fileDiagnostics are the diagnostics a server reported for a document.
+type fileDiagnostics struct {
+	URI         string           `json:"uri"`
+	Source      string           `json:"source"`
+	Version     int              `json:"version,omitempty"`
+	Diagnostics []lsp.Diagnostic `json:"diagnostics"`
+	// resultID of the last pulled report, sent with the next pull
+	resultID string
+}
+
+// documentDiagnosticReport is the result of a textDocument/diagnostic pull.
+type documentDiagnosticReport struct {
+	// Kind is "full" or "unchanged", an unchanged report keeps the items of
+	// the previous one.
+	Kind             string                              `json:"kind"`
+	ResultID         string                              `json:"resultId,omitempty"`
+	Items            []lsp.Diagnostic                    `json:"items"`
+	RelatedDocuments map[string]documentDiagnosticReport `json:"relatedDocuments,omitempty"`
+}
+
+// diagnosticStore holds the latest diagnostics by document uri and server,
+// published and pulled diagnostics end up here.
+type diagnosticStore struct {
+	docs map[string]map[string]*fileDiagnostics
+	sync.Mutex
+}
+
+var store = &diagnosticStore{docs: map[string]map[string]*fileDiagnostics{}}
+
+func (ds *diagnosticStore) set(d fileDiagnostics) {
+	ds.Lock()
+	defer ds.Unlock()
+	if len(d.Diagnostics) == 0 && len(d.resultID) == 0 {
+		delete(ds.docs[d.URI], d.Source)
+		if len(ds.docs[d.URI]) == 0 {
+			delete(ds.docs, d.URI)
+		}
+		return
+	}
+	if ds.docs[d.URI] == nil {
+		ds.docs[d.URI] = map[string]*fileDiagnostics{}
+	}
+	ds.docs[d.URI][d.Source] = &d
+}
+
+// get returns the diagnostics source reported for uri.
+func (ds *diagnosticStore) get(uri, source string) (fileDiagnostics, bool) {
+	ds.Lock()
+	defer ds.Unlock()
+	d, ok := ds.docs[uri][source]
+	if !ok {
+		return fileDiagnostics{}, false
+	}
+
+	return *d, true
+}
+
+// document returns the diagnostics of uri of all servers.
+func (ds *diagnosticStore) document(uri string) []fileDiagnostics {
+	ds.Lock()
+	defer ds.Unlock()
+	result := []fileDiagnostics{}
+	for _, d := range ds.docs[uri] {
+		if len(d.Diagnostics) > 0 {
+			result = append(result, *d)
+		}
+	}
+	sortDiagnostics(result)
+
+	return result
+}
+
+// workspace returns the diagnostics of all documents below the folder uri,
+// an empty folder matches every document.
+func (ds *diagnosticStore) workspace(folder string) []fileDiagnostics {
+	ds.Lock()
+	defer ds.Unlock()
+	result := []fileDiagnostics{}
+	for uri, sources := range ds.docs {
+		if !inFolder(uri, folder) {
+			continue
+		}
+		for _, d := range sources {
+			if len(d.Diagnostics) > 0 {
+				result = append(result, *d)
+			}
+		}
+	}
+	sortDiagnostics(result)
+
+	return result
+}
+
+// clear drops the diagnostics of a server, they are outdated once it exits.
+func (ds *diagnosticStore) clear(source string) {
+	ds.Lock()
+	defer ds.Unlock()
+	for uri, sources := range ds.docs {
+		delete(sources, source)
+		if len(sources) == 0 {
+			delete(ds.docs, uri)
+		}
+	}
+}
+
+func sortDiagnostics(result []fileDiagnostics) {
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].URI != result[j].URI {
+			return result[i].URI < result[j].URI
+		}
+		return result[i].Source < result[j].Source
+	})
+}
+
+// storeReport stores a pulled report, unchanged reports keep the stored items.
+func (h *handler) storeReport(uri lsp.DocumentURI, report documentDiagnosticReport) {
+	if report.Kind != "full" {
+		return
+	}
+	if report.Items == nil {
+		report.Items = []lsp.Diagnostic{}
+	}
+	h.storeDiagnostics(&lsp.PublishDiagnosticsParams{URI: uri, Diagnostics: report.Items}, report.ResultID)
+}
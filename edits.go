@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tectiv3/go-lsp"
+)
+
+// workspaceEdit is an LSP WorkspaceEdit in either the changes or the documentChanges form.
+type workspaceEdit struct {
+	Changes         map[string][]lsp.TextEdit `json:"changes,omitempty"`
+	DocumentChanges []textDocumentEdit        `json:"documentChanges,omitempty"`
+}
+
+// textDocumentEdit is a documentChanges entry, file operations have a kind and are not supported.
+type textDocumentEdit struct {
+	Kind         string `json:"kind,omitempty"`
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Edits []lsp.TextEdit `json:"edits"`
+}
+
+// fileEdits are the text edits for one file of a workspace edit.
+type fileEdits struct {
+	Path  string         `json:"path"`
+	Edits []lsp.TextEdit `json:"edits"`
+}
+
+// files groups the edits by file path.
+func (e workspaceEdit) files() ([]fileEdits, error) {
+	byPath := map[string][]lsp.TextEdit{}
+	add := func(uri string, edits []lsp.TextEdit) error {
+		docURI, err := lsp.NewDocumentURIFromURL(uri)
+		if err != nil {
+			return err
+		}
+		path := docURI.AsPath().String()
+		byPath[path] = append(byPath[path], edits...)
+		return nil
+	}
+	for uri, edits := range e.Changes {
+		if err := add(uri, edits); err != nil {
+			return nil, err
+		}
+	}
+	for _, change := range e.DocumentChanges {
+		if len(change.Kind) != 0 {
+			return nil, fmt.Errorf("unsupported file operation: %s", change.Kind)
+		}
+		if err := add(change.TextDocument.URI, change.Edits); err != nil {
+			return nil, err
+		}
+	}
+
+	files := []fileEdits{}
+	for path, edits := range byPath {
+		files = append(files, fileEdits{path, edits})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	return files, nil
+}
+
+// newWorkspaceEdit converts an lsp.WorkspaceEdit.
+func newWorkspaceEdit(edit lsp.WorkspaceEdit) workspaceEdit {
+	changes := map[string][]lsp.TextEdit{}
+	for uri, edits := range edit.Changes {
+		changes[uri.String()] = edits
+	}
+
+	return workspaceEdit{Changes: changes}
+}
+
+// positionOffset returns the byte offset of an LSP position, whose character
+// counts UTF-16 code units. Positions past the end of a line or of the text
+// are clamped as the spec requires.
+func positionOffset(text string, pos lsp.Position) int {
+	offset := 0
+	for line := 0; line < pos.Line; line++ {
+		i := strings.IndexByte(text[offset:], '\n')
+		if i < 0 {
+			return len(text)
+		}
+		offset += i + 1
+	}
+
+	units := 0
+	for units < pos.Character && offset < len(text) {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		if r == '\n' {
+			break
+		}
+		if r >= 0x10000 {
+			units += 2
+		} else {
+			units++
+		}
+		offset += size
+	}
+
+	return offset
+}
+
+// utf16Len returns the length of text in UTF-16 code units.
+func utf16Len(text string) int {
+	units := 0
+	for _, r := range text {
+		if r >= 0x10000 {
+			units += 2
+		} else {
+			units++
+		}
+	}
+
+	return units
+}
+
+// applyTextEdits applies non overlapping edits, all computed against text.
+func applyTextEdits(text string, edits []lsp.TextEdit) (string, error) {
+	type span struct {
+		start, end int
+		newText    string
+	}
+	spans := make([]span, 0, len(edits))
+	for _, edit := range edits {
+		start := positionOffset(text, edit.Range.Start)
+		end := positionOffset(text, edit.Range.End)
+		if end < start {
+			return "", fmt.Errorf("invalid edit range %s", edit.Range)
+		}
+		spans = append(spans, span{start, end, edit.NewText})
+	}
+	// apply from the end so earlier offsets stay valid, inserts at the same
+	// position keep their order
+	for i, j := 0, len(spans)-1; i < j; i, j = i+1, j-1 {
+		spans[i], spans[j] = spans[j], spans[i]
+	}
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start > spans[j].start })
+
+	for i, sp := range spans {
+		if i > 0 && sp.end > spans[i-1].start {
+			return "", fmt.Errorf("overlapping edits at offset %d", sp.start)
+		}
+		text = text[:sp.start] + sp.newText + text[sp.end:]
+	}
+
+	return text, nil
+}
+
+// renameFile replaces a file with its edited copy.
+var renameFile = os.Rename
+
+// applyFileEdits writes the edits to disk. Every file is edited in memory and
+// written to a temporary file first, so nothing is changed if any edit fails.
+// Replacing the files is only atomic per file, if a rename fails the files
+// before it stay edited and are returned as applied.
+func applyFileEdits(files []fileEdits) ([]string, error) {
+	type pending struct {
+		path, tmp string
+	}
+	var written []pending
+	cleanup := func() {
+		for _, p := range written {
+			os.Remove(p.tmp)
+		}
+	}
+
+	for _, f := range files {
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		content, err := os.ReadFile(f.Path)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		text, err := applyTextEdits(string(content), f.Edits)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("%s: %w", f.Path, err)
+		}
+
+		tmp, err := os.CreateTemp(filepath.Dir(f.Path), "."+filepath.Base(f.Path)+".*")
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		written = append(written, pending{f.Path, tmp.Name()})
+		if _, err := tmp.WriteString(text); err != nil {
+			tmp.Close()
+			cleanup()
+			return nil, err
+		}
+		if err := tmp.Close(); err != nil {
+			cleanup()
+			return nil, err
+		}
+		if err := os.Chmod(tmp.Name(), info.Mode()); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	applied := []string{}
+	for i, p := range written {
+		if err := renameFile(p.tmp, p.path); err != nil {
+			cleanup()
+			return applied, fmt.Errorf("%s: %w", p.path, err)
+		}
+		written[i].tmp = ""
+		applied = append(applied, p.path)
+	}
+
+	return applied, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tectiv3/go-lsp"
+)
+
+func textEdit(startLine, startChar, endLine, endChar int, newText string) lsp.TextEdit {
+	return lsp.TextEdit{
+		Range: lsp.Range{
+			Start: lsp.Position{Line: startLine, Character: startChar},
+			End:   lsp.Position{Line: endLine, Character: endChar},
+		},
+		NewText: newText,
+	}
+}
+
+func TestApplyTextEdits(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		edits []lsp.TextEdit
+		want  string
+		err   bool
+	}{
+		{"replace", "a := 1\nb := 2\n", []lsp.TextEdit{textEdit(1, 5, 1, 6, "3")}, "a := 1\nb := 3\n", false},
+		{"utf-16 columns", "x := \"😀é\" + y\n", []lsp.TextEdit{textEdit(0, 13, 0, 14, "z")}, "x := \"😀é\" + z\n", false},
+		{"after surrogate pair", "😀a", []lsp.TextEdit{textEdit(0, 2, 0, 3, "b")}, "😀b", false},
+		{"edits in any order", "abc", []lsp.TextEdit{textEdit(0, 2, 0, 3, "C"), textEdit(0, 0, 0, 1, "A")}, "AbC", false},
+		{"inserts at one position", "ac", []lsp.TextEdit{textEdit(0, 1, 0, 1, "b"), textEdit(0, 1, 0, 1, "B")}, "abBc", false},
+		{"insert and replace at one position", "ac", []lsp.TextEdit{textEdit(0, 1, 0, 1, "b"), textEdit(0, 1, 0, 2, "C")}, "abC", false},
+		{"past end of line", "ab\ncd", []lsp.TextEdit{textEdit(0, 10, 0, 10, "!")}, "ab!\ncd", false},
+		{"past end of file", "ab\n", []lsp.TextEdit{textEdit(5, 0, 6, 0, "cd\n")}, "ab\ncd\n", false},
+		{"overlapping", "abcdef", []lsp.TextEdit{textEdit(0, 0, 0, 3, "x"), textEdit(0, 2, 0, 4, "y")}, "", true},
+		{"inverted range", "abc", []lsp.TextEdit{textEdit(0, 2, 0, 1, "x")}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyTextEdits(tt.text, tt.edits)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkFiles(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		names := []string{}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("files %v, want %d", names, len(want))
+	}
+	for name, content := range want {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("%s: got %q, want %q", name, got, content)
+		}
+	}
+}
+
+func TestApplyFileEdits(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.go": "a", "b.go": "b"})
+	applied, err := applyFileEdits([]fileEdits{
+		{filepath.Join(dir, "a.go"), []lsp.TextEdit{textEdit(0, 1, 0, 1, "1")}},
+		{filepath.Join(dir, "b.go"), []lsp.TextEdit{textEdit(0, 0, 0, 1, "c")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 {
+		t.Errorf("applied %v", applied)
+	}
+	checkFiles(t, dir, map[string]string{"a.go": "a1", "b.go": "c"})
+}
+
+func TestApplyFileEditsInvalidEdit(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.go": "a", "b.go": "b"})
+	applied, err := applyFileEdits([]fileEdits{
+		{filepath.Join(dir, "a.go"), []lsp.TextEdit{textEdit(0, 1, 0, 1, "1")}},
+		{filepath.Join(dir, "b.go"), []lsp.TextEdit{textEdit(0, 1, 0, 0, "c")}},
+	})
+	if err == nil {
+		t.Fatal("invalid edit was applied")
+	}
+	if len(applied) != 0 {
+		t.Errorf("applied %v", applied)
+	}
+	checkFiles(t, dir, map[string]string{"a.go": "a", "b.go": "b"})
+}
+
+func TestApplyFileEditsRenameFailure(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.go": "a", "b.go": "b", "c.go": "c"})
+	defer func(rename func(string, string) error) { renameFile = rename }(renameFile)
+	renameFile = func(tmp, path string) error {
+		if filepath.Base(path) == "b.go" {
+			return errors.New("rename failed")
+		}
+		return os.Rename(tmp, path)
+	}
+
+	applied, err := applyFileEdits([]fileEdits{
+		{filepath.Join(dir, "a.go"), []lsp.TextEdit{textEdit(0, 1, 0, 1, "1")}},
+		{filepath.Join(dir, "b.go"), []lsp.TextEdit{textEdit(0, 1, 0, 1, "2")}},
+		{filepath.Join(dir, "c.go"), []lsp.TextEdit{textEdit(0, 1, 0, 1, "3")}},
+	})
+	if err == nil {
+		t.Fatal("rename failure was not returned")
+	}
+	if len(applied) != 1 || applied[0] != filepath.Join(dir, "a.go") {
+		t.Errorf("applied %v", applied)
+	}
+	// no temporary files are left behind
+	checkFiles(t, dir, map[string]string{"a.go": "a1", "b.go": "b", "c.go": "c"})
+}
+
+func TestDocumentUpdate(t *testing.T) {
+	r := func(startLine, startChar, endLine, endChar int) *lsp.Range {
+		edit := textEdit(startLine, startChar, endLine, endChar, "")
+		return &edit.Range
+	}
+	tests := []struct {
+		name    string
+		text    string
+		changes []lsp.TextDocumentContentChangeEvent
+		want    string
+	}{
+		{"full text", "a", []lsp.TextDocumentContentChangeEvent{{Text: "b"}}, "b"},
+		{"incremental", "a\nb\n", []lsp.TextDocumentContentChangeEvent{{Range: r(1, 0, 1, 1), Text: "c"}}, "a\nc\n"},
+		{
+			"changes apply in order", "abc", []lsp.TextDocumentContentChangeEvent{
+				{Range: r(0, 0, 0, 1), Text: "xy"},
+				{Range: r(0, 2, 0, 3), Text: "B"},
+			}, "xyBc",
+		},
+		{
+			"full text then incremental", "abc", []lsp.TextDocumentContentChangeEvent{
+				{Text: "😀d"},
+				{Range: r(0, 2, 0, 3), Text: "e"},
+			}, "😀e",
+		},
+		{"invalid range keeps text", "abc", []lsp.TextDocumentContentChangeEvent{{Range: r(0, 2, 0, 1), Text: "x"}}, "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &document{text: tt.text}
+			d.update(tt.changes)
+			if d.text != tt.want {
+				t.Errorf("got %q, want %q", d.text, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/tectiv3/go-lsp/jsonrpc"
+)
+
+// Error codes of failed IDE requests
+const (
+	errNotInitialized     = "not_initialized"
+	errBackendUnavailable = "backend_unavailable"
+	errBackendError       = "backend_error"
+	errTimeout            = "timeout"
+	errBadRequest         = "bad_request"
+	errInternal           = "internal_error"
+)
+
+// apiError is the error of every failed IDE request, the response is
+// {"status": "error", "error": apiError}.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// LSP is the error response of the language server for backend_error.
+	LSP *jsonrpc.ResponseError `json:"lsp,omitempty"`
+	// Fields are the invalid fields for bad_request.
+	Fields []fieldError `json:"fields,omitempty"`
+}
+
+// httpStatus returns the HTTP status code for an error code.
+func (e apiError) httpStatus() int {
+	switch e.Code {
+	case errNotInitialized:
+		return http.StatusConflict
+	case errBackendUnavailable:
+		return http.StatusServiceUnavailable
+	case errBackendError:
+		return http.StatusBadGateway
+	case errTimeout:
+		return http.StatusGatewayTimeout
+	case errBadRequest:
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+func errorResult(code string, format string, a ...interface{}) *KeyValue {
+	return &KeyValue{"status": "error", "error": apiError{Code: code, Message: fmt.Sprintf(format, a...)}}
+}
+
+func badRequest(err error) *KeyValue {
+	return errorResult(errBadRequest, "%s", err)
+}
+
+// backendError converts the result of a failed LSP request.
+func backendError(ctx context.Context, respErr *jsonrpc.ResponseError, err error) *KeyValue {
+	if ctx.Err() != nil {
+		return contextError(ctx)
+	}
+	if respErr != nil {
+		LogError(fmt.Errorf("%d: %s", respErr.Code, respErr.Message))
+		return &KeyValue{"status": "error", "error": apiError{Code: errBackendError, Message: respErr.Message, LSP: respErr}}
+	}
+	LogError(err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorResult(errTimeout, "%s", err)
+	}
+
+	return errorResult(errBackendUnavailable, "%s", err)
+}
+
+// contextError is the result of a request whose context is done.
+func contextError(ctx context.Context) *KeyValue {
+	if errors.Is(context.Cause(ctx), errSuperseded) {
+		return &KeyValue{"status": "superseded"}
+	}
+
+	return errorResult(errTimeout, "%s", ctx.Err())
+}
+
+// resultError returns the error of a failed request result.
+func resultError(result *KeyValue) (apiError, bool) {
+	if result == nil {
+		return apiError{}, false
+	}
+	e, ok := (*result)["error"].(apiError)
+
+	return e, ok
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/json"
+)
+
+// Event types pushed to subscribers
+const (
+	eventDiagnostics   = "diagnostics"
+	eventProgress      = "progress"
+	eventMessage       = "message"
+	eventCopilotStatus = "copilotStatus"
+	eventCopilotChat   = "copilotChat"
+)
+
+// event is server initiated traffic pushed to the IDE. Events with a URI
+// belong to a document, all others are delivered to every subscriber.
+type event struct {
+	Type   string      `json:"type"`
+	Server string      `json:"server,omitempty"`
+	URI    string      `json:"uri,omitempty"`
+	Data   interface{} `json:"data"`
+}
+
+// subscriber receives the events of a workspace or of single documents.
+type subscriber struct {
+	events chan event
+	// folder is the uri of the subscribed workspace
+	folder string
+	uris   map[string]bool
+}
+
+func (sub *subscriber) wants(e event) bool {
+	if len(e.URI) == 0 {
+		return true
+	}
+	if len(sub.uris) > 0 {
+		return sub.uris[e.URI]
+	}
+
+	return inFolder(e.URI, sub.folder)
+}
+
+// eventHub fans events out to subscribers, slow subscribers miss events
+// instead of blocking the language servers.
+type eventHub struct {
+	subscribers map[*subscriber]bool
+	// progress are the tokens of work done progress that has not ended
+	progress map[string]bool
+	sync.Mutex
+}
+
+var events = &eventHub{subscribers: map[*subscriber]bool{}, progress: map[string]bool{}}
+
+func (hub *eventHub) publish(e event) {
+	hub.Lock()
+	defer hub.Unlock()
+	if e.Type == eventProgress {
+		token, kind := progressKind(e)
+		switch kind {
+		case "begin":
+			hub.progress[token] = true
+		case "end":
+			delete(hub.progress, token)
+		}
+	}
+	for sub := range hub.subscribers {
+		if !sub.wants(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+		}
+	}
+}
+
+// busy reports whether a server is still working, e.g. indexing.
+func (hub *eventHub) busy() bool {
+	hub.Lock()
+	defer hub.Unlock()
+
+	return len(hub.progress) > 0
+}
+
+// endProgress drops the progress of a server that exited.
+func (hub *eventHub) endProgress(server string) {
+	hub.Lock()
+	defer hub.Unlock()
+	for token := range hub.progress {
+		if strings.HasPrefix(token, server+" ") {
+			delete(hub.progress, token)
+		}
+	}
+}
+
+// progressKind returns the token and the begin, report or end kind of a
+// progress event.
+func progressKind(e event) (string, string) {
+	p := struct {
+		Token json.RawMessage `json:"token"`
+		Value struct {
+			Kind string `json:"kind"`
+		} `json:"value"`
+	}{}
+	data, _ := json.Marshal(e.Data)
+	if err := json.Unmarshal(data, &p); err != nil {
+		return "", ""
+	}
+
+	return e.Server + " " + string(p.Token), p.Value.Kind
+}
+
+func (hub *eventHub) subscribe(sub *subscriber) {
+	hub.Lock()
+	hub.subscribers[sub] = true
+	hub.Unlock()
+}
+
+func (hub *eventHub) unsubscribe(sub *subscriber) {
+	hub.Lock()
+	if hub.subscribers[sub] {
+		delete(hub.subscribers, sub)
+		close(sub.events)
+	}
+	hub.Unlock()
+}
+
+// closeAll ends every subscription, used on shutdown.
+func (hub *eventHub) closeAll() {
+	hub.Lock()
+	for sub := range hub.subscribers {
+		delete(hub.subscribers, sub)
+		close(sub.events)
+	}
+	hub.Unlock()
+}
+
+// serveEvents streams events as Server-Sent Events. The query selects a
+// workspace by name or documents by uri, e.g. /events?workspace=app or
+// /events?uri=file:///app/index.php&uri=file:///app/main.go.
+func (s *mateServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sub := &subscriber{events: make(chan event, 64), uris: map[string]bool{}}
+	query := r.URL.Query()
+	if name := query.Get("workspace"); len(name) != 0 {
+		folder, ok := s.workspaceURI(name)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(errorResult(errBadRequest, "unknown workspace %s", name))
+			return
+		}
+		sub.folder = folder
+	}
+	for _, uri := range query["uri"] {
+		sub.uris[uri] = true
+	}
+	events.subscribe(sub)
+	defer events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
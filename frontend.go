@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/tectiv3/go-lsp"
+	"github.com/tectiv3/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// lspFrontend is a connection of an editor that speaks LSP, lsp-client acts as
+// a single language server in front of all backends. Requests are routed to
+// the backend of the document and passed through unchanged, document sync goes
+// through the IDE API so Copilot and the backends share the open documents.
+type lspFrontend struct {
+	conn *jsonrpc.Connection
+	// exit closes the connection, done is closed afterwards
+	exit func()
+	done chan struct{}
+	once sync.Once
+}
+
+// resolvedItems are the requests whose items are resolved with codeAction/resolve
+// and completionItem/resolve, the items carry their backend in data.
+var resolvedItems = map[string]bool{
+	"textDocument/codeAction": true,
+	"textDocument/completion": true,
+}
+
+// itemData wraps the data of an item with the name of its backend.
+type itemData struct {
+	Server string          `json:"lspClientServer"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// errCodeRequestFailed is the LSP 3.17 RequestFailed error code.
+const errCodeRequestFailed jsonrpc.ErrorCode = -32803
+
+// rawRequest is an LSP request passed through to a backend.
+type rawRequest struct {
+	Method string          `json:"method,required"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+var lspFrontends = struct {
+	conns map[*lspFrontend]bool
+	sync.Mutex
+}{conns: map[*lspFrontend]bool{}}
+
+// startLSPFrontend listens on "stdio", "tcp://host:port" or "unix:///path".
+// The returned channel is closed when a stdio session ends.
+func startLSPFrontend(listen string) (<-chan struct{}, error) {
+	if listen == "stdio" {
+		// keep stray prints of the process off the protocol stream
+		stdout := os.Stdout
+		os.Stdout = os.Stderr
+		Log("Serving LSP on stdio")
+		f := serveLSP(NewReadWriteCloser(os.Stdin, stdout))
+		return f.done, nil
+	}
+
+	network, address, ok := strings.Cut(listen, "://")
+	if !ok || (network != "tcp" && network != "unix") {
+		return nil, fmt.Errorf("invalid lsp_listen %q", listen)
+	}
+	if network == "unix" {
+		os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	Log("Serving LSP on %s", listen)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				LogError(err)
+				return
+			}
+			serveLSP(conn)
+		}
+	}()
+
+	return nil, nil
+}
+
+func serveLSP(rw io.ReadWriteCloser) *lspFrontend {
+	f := &lspFrontend{done: make(chan struct{})}
+	f.exit = func() { f.close(rw) }
+	f.conn = jsonrpc.NewConnection(rw, rw, f.handleRequest, f.handleNotification, func(err error) {
+		if err != io.EOF {
+			LogError(err)
+		}
+		f.exit()
+	})
+	f.conn.SetLogger(&Logger{
+		IncomingPrefix: "LSP <-- Editor", OutgoingPrefix: "LSP --> Editor",
+		HiColor: hiCyanString, LoColor: cyanString, ErrorColor: errorString,
+	})
+
+	lspFrontends.Lock()
+	lspFrontends.conns[f] = true
+	lspFrontends.Unlock()
+
+	go f.conn.Run()
+
+	return f
+}
+
+func (f *lspFrontend) close(c io.Closer) {
+	f.once.Do(func() {
+		lspFrontends.Lock()
+		delete(lspFrontends.conns, f)
+		lspFrontends.Unlock()
+		c.Close()
+		close(f.done)
+	})
+}
+
+// frontendCapabilities are the features routed to the backends.
+var frontendCapabilities = lsp.KeyValue{
+	"textDocumentSync": lsp.KeyValue{
+		"openClose": true,
+		"change":    lsp.TextDocumentSyncKindIncremental,
+	},
+	"hoverProvider": true,
+	"completionProvider": lsp.KeyValue{
+		"triggerCharacters": []string{".", ":", ">", "$", "\\"},
+		"resolveProvider":   true,
+	},
+	"signatureHelpProvider":           lsp.KeyValue{"triggerCharacters": []string{"(", ","}},
+	"definitionProvider":              true,
+	"declarationProvider":             true,
+	"typeDefinitionProvider":          true,
+	"implementationProvider":          true,
+	"referencesProvider":              true,
+	"documentSymbolProvider":          true,
+	"workspaceSymbolProvider":         true,
+	"codeActionProvider":              lsp.KeyValue{"resolveProvider": true},
+	"documentFormattingProvider":      true,
+	"documentRangeFormattingProvider": true,
+	"renameProvider":                  lsp.KeyValue{"prepareProvider": true},
+}
+
+func (f *lspFrontend) handleRequest(ctx context.Context, logger jsonrpc.FunctionLogger, method string, params json.RawMessage, respond func(json.RawMessage, *jsonrpc.ResponseError)) {
+	go func() {
+		defer catchAndLogPanic(func() {
+			respond(nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInternalError, Message: "internal error"})
+		})
+		ctx, cancel := context.WithTimeout(ctx, config.timeout(method))
+		defer cancel()
+
+		switch method {
+		case "initialize":
+			respond(f.initialize(ctx, params))
+		case "shutdown":
+			respond(jsonrpc.NullResult, nil)
+		case "workspace/symbol":
+			respond(f.workspaceSymbol(ctx, params))
+		case "workspace/executeCommand":
+			respond(f.executeCommand(ctx, params))
+		case "codeAction/resolve", "completionItem/resolve":
+			respond(f.resolve(ctx, method, params))
+		default:
+			if !strings.HasPrefix(method, "textDocument/") {
+				respond(nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesMethodNotFound, Message: "unsupported method " + method})
+				return
+			}
+			respond(f.forward(ctx, method, params))
+		}
+	}()
+}
+
+func (f *lspFrontend) handleNotification(logger jsonrpc.FunctionLogger, method string, params json.RawMessage) {
+	ctx := context.Background()
+	switch method {
+	case "textDocument/didOpen":
+		p := lsp.DidOpenTextDocumentParams{}
+		if err := json.Unmarshal(params, &p); err != nil {
+			LogError(err)
+			return
+		}
+		f.call(ctx, "didOpen", didOpenRequest{
+			URI:        p.TextDocument.URI.String(),
+			LanguageId: p.TextDocument.LanguageID,
+			Version:    p.TextDocument.Version,
+			Text:       p.TextDocument.Text,
+		})
+	case "textDocument/didChange":
+		p := lsp.DidChangeTextDocumentParams{}
+		if err := json.Unmarshal(params, &p); err != nil {
+			LogError(err)
+			return
+		}
+		uri := p.TextDocument.URI.String()
+		f.call(ctx, "didChange", didChangeRequest{
+			URI:        uri,
+			LanguageId: server.documentLanguage(uri),
+			Version:    &p.TextDocument.Version,
+			Changes:    p.ContentChanges,
+		})
+	case "textDocument/didClose":
+		p := lsp.DidCloseTextDocumentParams{}
+		if err := json.Unmarshal(params, &p); err != nil {
+			LogError(err)
+			return
+		}
+		uri := p.TextDocument.URI.String()
+		f.call(ctx, "didClose", didCloseRequest{URI: uri, LanguageId: server.documentLanguage(uri)})
+	case "exit":
+		f.exit()
+	}
+}
+
+// call runs an IDE API method.
+func (f *lspFrontend) call(ctx context.Context, method string, params interface{}) *KeyValue {
+	body, _ := json.Marshal(params)
+	cb := make(kvChan, 1)
+	server.processRequest(mateRequest{Method: method, Body: body, ctx: ctx}, cb)
+
+	return <-cb
+}
+
+func (f *lspFrontend) initialize(ctx context.Context, params json.RawMessage) (json.RawMessage, *jsonrpc.ResponseError) {
+	p := struct {
+		RootURI          string                 `json:"rootUri"`
+		RootPath         string                 `json:"rootPath"`
+		WorkspaceFolders []workspaceFolderParam `json:"workspaceFolders"`
+	}{}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	dir := p.RootPath
+	if uri, err := lsp.NewDocumentURIFromURL(p.RootURI); err == nil && len(p.RootURI) != 0 {
+		dir = uri.AsPath().String()
+	}
+	if len(dir) == 0 && len(p.WorkspaceFolders) > 0 {
+		if uri, err := lsp.NewDocumentURIFromURL(p.WorkspaceFolders[0].URI); err == nil {
+			dir = uri.AsPath().String()
+		}
+	}
+
+	result := f.call(ctx, "initialize", initializeRequest{Dir: dir, Name: filepath.Base(dir), Folders: p.WorkspaceFolders})
+	if respErr := responseError(result); respErr != nil {
+		return nil, respErr
+	}
+
+	// commands are known once the backends are initialized
+	capabilities := lsp.KeyValue{}
+	for k, v := range frontendCapabilities {
+		capabilities[k] = v
+	}
+	commands := []string{}
+	for _, ls := range server.backends {
+		commands = append(commands, ls.commands()...)
+	}
+	capabilities["executeCommandProvider"] = lsp.KeyValue{"commands": commands}
+
+	return lsp.EncodeMessage(KeyValue{
+		"capabilities": capabilities,
+		"serverInfo":   KeyValue{"name": "lsp-client"},
+	}), nil
+}
+
+// forward passes a document request to the backend of the document.
+func (f *lspFrontend) forward(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, *jsonrpc.ResponseError) {
+	p := struct {
+		TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+	}{}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	uri := p.TextDocument.URI.String()
+	ls := server.backendFor(server.documentLanguage(uri), uri)
+	if ls == nil {
+		return nil, &jsonrpc.ResponseError{Code: errCodeRequestFailed, Message: "no language server for " + uri}
+	}
+
+	response, respErr := f.raw(ctx, ls, method, params)
+	if respErr == nil && resolvedItems[method] {
+		response = tagItems(ls.Name, response)
+	}
+
+	return response, respErr
+}
+
+// tagItems adds the backend name to the data of the items of a completion or
+// code action result.
+func tagItems(name string, response json.RawMessage) json.RawMessage {
+	list := map[string]json.RawMessage{}
+	if json.Unmarshal(response, &list) == nil && list["items"] != nil {
+		list["items"] = tagItems(name, list["items"])
+		return lsp.EncodeMessage(list)
+	}
+	items := []map[string]json.RawMessage{}
+	if err := json.Unmarshal(response, &items); err != nil || items == nil {
+		return response
+	}
+	for _, item := range items {
+		item["data"] = lsp.EncodeMessage(itemData{name, item["data"]})
+	}
+
+	return lsp.EncodeMessage(items)
+}
+
+// raw passes a request to a backend unchanged.
+func (f *lspFrontend) raw(ctx context.Context, ls *languageServer, method string, params json.RawMessage) (json.RawMessage, *jsonrpc.ResponseError) {
+	result := server.sendLSPRequest(ctx, ls.in, "raw", rawRequest{method, params})
+	if respErr := responseError(result); respErr != nil {
+		return nil, respErr
+	}
+
+	return (*result)["result"].(json.RawMessage), nil
+}
+
+// resolve passes a resolve request to the backend that returned the item, the
+// item is passed with its original data.
+func (f *lspFrontend) resolve(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, *jsonrpc.ResponseError) {
+	item := map[string]json.RawMessage{}
+	if err := json.Unmarshal(params, &item); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	data := itemData{}
+	if err := json.Unmarshal(item["data"], &data); err != nil || len(data.Server) == 0 {
+		return nil, &jsonrpc.ResponseError{Code: errCodeRequestFailed, Message: "no language server for the item"}
+	}
+	var ls *languageServer
+	for _, backend := range server.backends {
+		if backend.Name == data.Server {
+			ls = backend
+		}
+	}
+	if ls == nil {
+		return nil, &jsonrpc.ResponseError{Code: errCodeRequestFailed, Message: "no language server " + data.Server}
+	}
+	if len(data.Data) == 0 {
+		delete(item, "data")
+	} else {
+		item["data"] = data.Data
+	}
+
+	response, respErr := f.raw(ctx, ls, method, lsp.EncodeMessage(item))
+	if respErr != nil {
+		return nil, respErr
+	}
+	// the resolved item is resolved again by some editors
+	resolved := map[string]json.RawMessage{}
+	if json.Unmarshal(response, &resolved) == nil && resolved != nil {
+		resolved["data"] = lsp.EncodeMessage(itemData{ls.Name, resolved["data"]})
+		response = lsp.EncodeMessage(resolved)
+	}
+
+	return response, nil
+}
+
+// executeCommand runs a command on the backend that advertised it, the edits
+// the backend applies meanwhile are sent to the editor as workspace/applyEdit.
+func (f *lspFrontend) executeCommand(ctx context.Context, params json.RawMessage) (json.RawMessage, *jsonrpc.ResponseError) {
+	cmd := command{}
+	if err := json.Unmarshal(params, &cmd); err != nil {
+		return nil, &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesInvalidParams, Message: err.Error()}
+	}
+	ls := server.backendForCommand(cmd.Command)
+	if ls == nil {
+		return nil, &jsonrpc.ResponseError{Code: errCodeRequestFailed, Message: "no language server for command " + cmd.Command}
+	}
+
+	result := server.sendLSPRequest(ctx, ls.in, "executeCodeAction", KeyValue{"action": params})
+	if respErr := responseError(result); respErr != nil {
+		return nil, respErr
+	}
+	edits, _ := (*result)["result"].([]workspaceEdit)
+	for _, edit := range edits {
+		_, respErr, err := f.conn.SendRequest(ctx, "workspace/applyEdit", lsp.EncodeMessage(KeyValue{
+			"label": cmd.Title,
+			"edit":  edit,
+		}))
+		if err != nil {
+			return nil, &jsonrpc.ResponseError{Code: errCodeRequestFailed, Message: err.Error()}
+		}
+		if respErr != nil {
+			return nil, respErr
+		}
+	}
+
+	return jsonrpc.NullResult, nil
+}
+
+// workspaceSymbol merges the symbols of all backends.
+func (f *lspFrontend) workspaceSymbol(ctx context.Context, params json.RawMessage) (json.RawMessage, *jsonrpc.ResponseError) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	symbols := []json.RawMessage{}
+	for _, ls := range server.backends {
+		wg.Add(1)
+		go func(ls *languageServer) {
+			defer wg.Done()
+			result := server.sendLSPRequest(ctx, ls.in, "raw", rawRequest{"workspace/symbol", params})
+			response, ok := (*result)["result"].(json.RawMessage)
+			if !ok {
+				return
+			}
+			found := []json.RawMessage{}
+			if err := json.Unmarshal(response, &found); err != nil {
+				return
+			}
+			mu.Lock()
+			symbols = append(symbols, found...)
+			mu.Unlock()
+		}(ls)
+	}
+	wg.Wait()
+
+	return lsp.EncodeMessage(symbols), nil
+}
+
+// responseError converts a failed IDE API result to an LSP error.
+func responseError(result *KeyValue) *jsonrpc.ResponseError {
+	if (*result)["status"] == "superseded" {
+		return &jsonrpc.ResponseError{Code: jsonrpc.ErrorCodesRequestCancelled, Message: "superseded"}
+	}
+	e, ok := resultError(result)
+	if !ok {
+		return nil
+	}
+	if e.LSP != nil {
+		return e.LSP
+	}
+	code := errCodeRequestFailed
+	switch e.Code {
+	case errNotInitialized:
+		code = jsonrpc.ErrorCodesServerNotInitialized
+	case errBadRequest:
+		code = jsonrpc.ErrorCodesInvalidParams
+	case errTimeout:
+		code = jsonrpc.ErrorCodesRequestCancelled
+	case errInternal:
+		code = jsonrpc.ErrorCodesInternalError
+	}
+
+	return &jsonrpc.ResponseError{Code: code, Message: e.Message}
+}
+
+// publishDiagnostics forwards diagnostics of a backend to the LSP editors.
+func publishDiagnostics(params *lsp.PublishDiagnosticsParams) {
+	lspFrontends.Lock()
+	defer lspFrontends.Unlock()
+	for f := range lspFrontends.conns {
+		f.conn.SendNotification("textDocument/publishDiagnostics", lsp.EncodeMessage(params))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"go.bug.st/json"
+)
+
+func TestTagItems(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{"null", `null`, `null`},
+		{"array", `[{"label":"a","data":1},{"label":"b"}]`,
+			`[{"data":{"lspClientServer":"gopls","data":1},"label":"a"},{"data":{"lspClientServer":"gopls"},"label":"b"}]`},
+		{"list", `{"isIncomplete":false,"items":[{"label":"a"}]}`,
+			`{"isIncomplete":false,"items":[{"data":{"lspClientServer":"gopls"},"label":"a"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tagItems("gopls", json.RawMessage(tt.response))
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestItemDataRoundTrip(t *testing.T) {
+	tagged := tagItems("intelephense", json.RawMessage(`[{"title":"fix","data":{"id":7}}]`))
+	items := []map[string]json.RawMessage{}
+	if err := json.Unmarshal(tagged, &items); err != nil {
+		t.Fatal(err)
+	}
+	data := itemData{}
+	if err := json.Unmarshal(items[0]["data"], &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Server != "intelephense" || string(data.Data) != `{"id":7}` {
+		t.Errorf("got %+v", data)
+	}
+}
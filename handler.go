@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -14,11 +15,24 @@ import (
 )
 
 type handler struct {
-	lsc                   *lsp.Client
-	Requests              map[string]string
-	Diagnostics           chan *lsp.PublishDiagnosticsParams
-	waitingForDiagnostics bool
-	config                KeyValue
+	// name of the server, events are published with it
+	name     string
+	lsc      *lsp.Client
+	Requests map[string]string
+	config   KeyValue
+	// pullDiagnostics is set when the server supports textDocument/diagnostic
+	pullDiagnostics bool
+	// commands are the commands of the executeCommandProvider
+	commands []string
+	// collector holds the edits of the running command, applyEdit requests are
+	// collected for the IDE instead of written to disk. commandMu lets one
+	// command run at a time so the edits belong to it.
+	collector *[]workspaceEdit
+	commandMu sync.Mutex
+	// done is closed when the server process exits
+	done    chan struct{}
+	process *os.Process
+	stdio   io.Closer
 	sync.Mutex
 }
 
@@ -26,8 +40,9 @@ func (h *handler) SetConfig(config KeyValue) {
 	h.config = config
 }
 
+// GetDiagnosticChannel is not used, diagnostics are kept in the diagnostic store.
 func (h *handler) GetDiagnosticChannel() chan *lsp.PublishDiagnosticsParams {
-	return h.Diagnostics
+	return nil
 }
 
 func (h *handler) ClientRegisterCapability(context.Context, jsonrpc.FunctionLogger, *lsp.RegistrationParams) *jsonrpc.ResponseError {
@@ -48,12 +63,15 @@ func (h *handler) LogTrace(logger jsonrpc.FunctionLogger, params *lsp.LogTracePa
 
 // Progress
 func (h *handler) Progress(logger jsonrpc.FunctionLogger, params *lsp.ProgressParams) {
-	log.Printf("Progress: %v", params)
+	if onChatProgress(params) {
+		return
+	}
+	events.publish(event{Type: eventProgress, Server: h.name, Data: params})
 }
 
 // WindowShowMessage
 func (h *handler) WindowShowMessage(logger jsonrpc.FunctionLogger, params *lsp.ShowMessageParams) {
-	log.Printf("WindowShowMessage: %v", params)
+	events.publish(event{Type: eventMessage, Server: h.name, Data: params})
 }
 
 // WindowLogMessage
@@ -72,6 +90,7 @@ func (h *handler) TextDocumentPublishDiagnostics(logger jsonrpc.FunctionLogger,
 		h.Lock()
 		defer h.Unlock()
 
+		h.storeDiagnostics(params, "")
 		uuid := h.Requests[params.URI.String()]
 		if len(uuid) == 0 {
 			return
@@ -86,6 +105,20 @@ func (h *handler) TextDocumentPublishDiagnostics(logger jsonrpc.FunctionLogger,
 	}()
 }
 
+// storeDiagnostics keeps published or pulled diagnostics in the store and
+// forwards them to the subscribers and LSP editors.
+func (h *handler) storeDiagnostics(params *lsp.PublishDiagnosticsParams, resultID string) {
+	store.set(fileDiagnostics{
+		URI:         params.URI.String(),
+		Source:      h.name,
+		Version:     params.Version,
+		Diagnostics: params.Diagnostics,
+		resultID:    resultID,
+	})
+	publishDiagnostics(params)
+	events.publish(event{Type: eventDiagnostics, Server: h.name, URI: params.URI.String(), Data: params})
+}
+
 // WindowShowMessageRequest
 func (h *handler) WindowShowMessageRequest(context.Context, jsonrpc.FunctionLogger, *lsp.ShowMessageRequestParams) (*lsp.MessageActionItem, *jsonrpc.ResponseError) {
 	return nil, nil
@@ -116,15 +149,44 @@ func (h *handler) WorkspaceWorkspaceFolders(context.Context, jsonrpc.FunctionLog
 }
 
 // WorkspaceConfiguration
-func (h *handler) WorkspaceConfiguration(context.Context, jsonrpc.FunctionLogger, *lsp.ConfigurationParams) ([]json.RawMessage, *jsonrpc.ResponseError) {
+func (h *handler) WorkspaceConfiguration(_ context.Context, _ jsonrpc.FunctionLogger, params *lsp.ConfigurationParams) ([]json.RawMessage, *jsonrpc.ResponseError) {
 	body, _ := json.Marshal(h.config)
 
-	return []json.RawMessage{body, body}, nil
+	// answer every requested section with the server settings
+	result := []json.RawMessage{}
+	for range params.Items {
+		result = append(result, body)
+	}
+
+	return result, nil
 }
 
-// WorkspaceApplyEdit
-func (h *handler) WorkspaceApplyEdit(context.Context, jsonrpc.FunctionLogger, *lsp.ApplyWorkspaceEditParams) (*lsp.ApplyWorkspaceEditResult, *jsonrpc.ResponseError) {
-	return nil, nil
+// WorkspaceApplyEdit writes edits requested by the server to files that are not open in the IDE
+func (h *handler) WorkspaceApplyEdit(_ context.Context, logger jsonrpc.FunctionLogger, params *lsp.ApplyWorkspaceEditParams) (*lsp.ApplyWorkspaceEditResult, *jsonrpc.ResponseError) {
+	h.Lock()
+	if h.collector != nil {
+		*h.collector = append(*h.collector, newWorkspaceEdit(params.Edit))
+		h.Unlock()
+		return &lsp.ApplyWorkspaceEditResult{Applied: true}, nil
+	}
+	h.Unlock()
+
+	files, err := newWorkspaceEdit(params.Edit).files()
+	if err != nil {
+		return &lsp.ApplyWorkspaceEditResult{Applied: false, FailureReason: err.Error()}, nil
+	}
+	for _, f := range files {
+		if server.isOpen(f.Path) {
+			return &lsp.ApplyWorkspaceEditResult{Applied: false, FailureReason: f.Path + " is open in the editor"}, nil
+		}
+	}
+	applied, err := applyFileEdits(files)
+	if err != nil {
+		return &lsp.ApplyWorkspaceEditResult{Applied: false, FailureReason: err.Error()}, nil
+	}
+	logger.Logf("WorkspaceApplyEdit: %v", applied)
+
+	return &lsp.ApplyWorkspaceEditResult{Applied: true}, nil
 }
 
 // WorkspaceCodeLensRefresh
@@ -132,20 +194,20 @@ func (h *handler) WorkspaceCodeLensRefresh(context.Context, jsonrpc.FunctionLogg
 	return nil
 }
 
-func startRPCServer(app, name string, args ...string) *handler {
+func startRPCServer(app, name string, args ...string) (*handler, error) {
 	var stdin io.WriteCloser
 	var stdout, stderr io.ReadCloser
 
 	cmd := exec.Command(name, args...)
 
 	if cin, err := cmd.StdinPipe(); err != nil {
-		panic("getting clangd stdin: " + err.Error())
+		return nil, fmt.Errorf("getting %s stdin: %w", app, err)
 	} else if cout, err := cmd.StdoutPipe(); err != nil {
-		panic("getting clangd stdout: " + err.Error())
+		return nil, fmt.Errorf("getting %s stdout: %w", app, err)
 	} else if cerr, err := cmd.StderrPipe(); err != nil {
-		panic("getting clangd stderr: " + err.Error())
+		return nil, fmt.Errorf("getting %s stderr: %w", app, err)
 	} else if err := cmd.Start(); err != nil {
-		panic("running clangd: " + err.Error())
+		return nil, fmt.Errorf("running %s: %w", app, err)
 	} else {
 		stdin = cin
 		stdout = cout
@@ -155,13 +217,20 @@ func startRPCServer(app, name string, args ...string) *handler {
 	stdio := NewReadWriteCloser(stdout, stdin)
 	if config.EnableLogging {
 		stdio = LogReadWriteCloserAs(stdio, app+".log")
-		go io.Copy(openLogFileAs(app+"-err.log"), stderr)
+		errLog := openLogFileAs(app + "-err.log")
+		go func() {
+			io.Copy(errLog, stderr)
+			errLog.Close()
+		}()
 	} else {
 		go io.Copy(os.Stderr, stderr)
 	}
 
 	handler := &handler{
-		Diagnostics: make(chan *lsp.PublishDiagnosticsParams),
+		name:    app,
+		done:    make(chan struct{}),
+		process: cmd.Process,
+		stdio:   stdio,
 	}
 	lsc := lsp.NewClient(stdio, stdio, handler, func(err error) {
 		log.Println(errorString("Error: %v", err))
@@ -170,8 +239,37 @@ func startRPCServer(app, name string, args ...string) *handler {
 
 	go func() {
 		defer stdin.Close()
-		cmd.Wait()
+		err := cmd.Wait()
+		Log("%s exited: %v", app, err)
+		close(handler.done)
 	}()
 
-	return handler
+	return handler, nil
+}
+
+// shutdown asks the server to exit and kills it if it is still running when
+// ctx expires. The connection is closed afterwards, which flushes its log.
+func (h *handler) shutdown(ctx context.Context) {
+	defer h.stdio.Close()
+
+	shutdown := make(chan struct{})
+	go func() {
+		h.lsc.Shutdown(ctx)
+		close(shutdown)
+	}()
+	select {
+	case <-shutdown:
+		h.lsc.Exit()
+	case <-h.done:
+		return
+	case <-ctx.Done():
+	}
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		Log("Killing process %d", h.process.Pid)
+		h.process.Kill()
+		<-h.done
+	}
 }
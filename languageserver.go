@@ -0,0 +1,799 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tectiv3/go-lsp"
+	"github.com/tectiv3/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// Restart backoff of crashed language servers
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+)
+
+// languageServer is a running backend from the registry.
+type languageServer struct {
+	ServerConfig
+	in mrChan
+	// initOptions builds initializationOptions from the initialize request,
+	// built-in servers use it for values that can be overridden per workspace.
+	initOptions func(params KeyValue) lsp.KeyValue
+	hiColor     func(format string, a ...interface{}) string
+	loColor     func(format string, a ...interface{}) string
+
+	client   *handler
+	restarts int
+	stopped  bool
+	// initParams are the params of the first initialize, a restart replays them
+	initParams KeyValue
+	sync.Mutex
+}
+
+// replayState is the IDE state a restarted server is brought to.
+type replayState struct {
+	initialize KeyValue
+	documents  map[string]document
+}
+
+// serverStatus is the state of a language server reported by the status method.
+type serverStatus struct {
+	Name     string `json:"name"`
+	Running  bool   `json:"running"`
+	Pid      int    `json:"pid,omitempty"`
+	Restarts int    `json:"restarts"`
+}
+
+// languageServers returns the built-in servers with a configured path, merged
+// with the servers declared in the config. Servers whose command is not found
+// are left out.
+func languageServers() []*languageServer {
+	var servers []*languageServer
+	for _, ls := range []*languageServer{intelephenseServer(), volarServer(), goplsServer()} {
+		if len(ls.Command) == 0 {
+			Log("%s path not set", ls.Name)
+			continue
+		}
+		servers = append(servers, ls)
+	}
+
+	for _, sc := range config.Servers {
+		if len(sc.Name) == 0 || len(sc.Command) == 0 {
+			Log("Skipping server without name or command: %v", sc)
+			continue
+		}
+		ls := &languageServer{ServerConfig: sc}
+		replaced := false
+		for i, s := range servers {
+			if s.Name == sc.Name {
+				servers[i] = ls
+				replaced = true
+			}
+		}
+		if !replaced {
+			servers = append(servers, ls)
+		}
+	}
+
+	// a missing command would be restarted forever
+	found := servers[:0]
+	for _, ls := range servers {
+		if _, err := exec.LookPath(ls.Command); err != nil {
+			Log("Skipping %s: %s", ls.Name, err)
+			continue
+		}
+		found = append(found, ls)
+	}
+
+	return found
+}
+
+// startLanguageServers starts every registered server and returns them for routing.
+func startLanguageServers() []*languageServer {
+	servers := languageServers()
+	for _, ls := range servers {
+		ls.in = make(mrChan, 2)
+		go ls.start()
+	}
+
+	return servers
+}
+
+// handles reports whether the server is responsible for the given document.
+func (ls *languageServer) handles(languageId, uri string) bool {
+	if len(languageId) != 0 {
+		for _, id := range ls.LanguageIds {
+			if id == languageId {
+				return true
+			}
+		}
+	}
+	if len(uri) != 0 {
+		base := filepath.Base(uri)
+		for _, glob := range ls.FileGlobs {
+			if ok, _ := filepath.Match(glob, base); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// start runs the server process and restarts it with backoff whenever it exits.
+func (ls *languageServer) start() {
+	delay := minRestartDelay
+	var state *replayState
+	for {
+		ls.Lock()
+		if ls.stopped {
+			ls.Unlock()
+			return
+		}
+		ls.Unlock()
+
+		started := time.Now()
+		c, err := ls.launch()
+		if err != nil {
+			LogError(err)
+		} else {
+			ls.Lock()
+			ls.client = c
+			ls.Unlock()
+			// initialize has to reach the server before any queued request
+			if state == nil || ls.replay(c, state) {
+				ls.processRequests(c)
+			}
+
+			ls.Lock()
+			ls.client = nil
+			stopped := ls.stopped
+			ls.Unlock()
+			store.clear(ls.Name)
+			events.endProgress(ls.Name)
+			if stopped {
+				return
+			}
+		}
+		if time.Since(started) > maxRestartDelay {
+			delay = minRestartDelay
+		}
+
+		ls.Lock()
+		ls.restarts++
+		ls.Unlock()
+		Log("Restarting %s in %s", ls.Name, delay)
+		ls.rejectRequests(delay)
+		state = ls.snapshot()
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// launch starts the server process and its connection.
+func (ls *languageServer) launch() (*handler, error) {
+	c, err := startRPCServer(ls.Name, ls.Command, ls.Args...)
+	if err != nil {
+		return nil, err
+	}
+	c.Requests = make(map[string]string)
+	c.SetConfig(ls.Settings)
+
+	hi, lo := ls.hiColor, ls.loColor
+	if hi == nil || lo == nil {
+		hi, lo = hiRedString, redString
+	}
+	c.lsc.SetLogger(&Logger{
+		IncomingPrefix: "LSP <-- " + ls.Name, OutgoingPrefix: "LSP --> " + ls.Name,
+		HiColor: hi, LoColor: lo, ErrorColor: errorString,
+	})
+	// intelephense reports indexing with its own notifications
+	for method, kind := range map[string]string{"indexingStarted": "begin", "indexingEnded": "end"} {
+		kind := kind
+		c.lsc.RegisterCustomNotification(method, func(jsonrpc.FunctionLogger, json.RawMessage) {
+			events.publish(event{Type: eventProgress, Server: ls.Name, Data: KeyValue{
+				"token": "indexing",
+				"value": KeyValue{"kind": kind, "title": "Indexing"},
+			}})
+		})
+	}
+	for _, method := range ls.Notifications {
+		c.lsc.RegisterCustomNotification(method, func(jsonrpc.FunctionLogger, json.RawMessage) {})
+	}
+
+	go c.lsc.Run()
+
+	return c, nil
+}
+
+// stop shuts the server down for good, it is not restarted afterwards.
+func (ls *languageServer) stop(ctx context.Context) {
+	ls.Lock()
+	ls.stopped = true
+	c := ls.client
+	ls.Unlock()
+	if c != nil {
+		Log("Stopping %s", ls.Name)
+		c.shutdown(ctx)
+	}
+}
+
+// rejectRequests answers requests with an error while the server is down.
+func (ls *languageServer) rejectRequests(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case request := <-ls.in:
+			request.CB <- errorResult(errBackendUnavailable, "%s is restarting", ls.Name)
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// snapshot returns the IDE state to replay, requests are rejected while it
+// waits for the server lock, its holder may be sending to the server.
+func (ls *languageServer) snapshot() *replayState {
+	result := make(chan *replayState, 1)
+	go func() { result <- ls.replayState() }()
+	for {
+		select {
+		case state := <-result:
+			return state
+		case request := <-ls.in:
+			request.CB <- errorResult(errBackendUnavailable, "%s is restarting", ls.Name)
+		}
+	}
+}
+
+// replayState collects the workspace folders and the open documents of the
+// server, it is nil if the server was not initialized.
+func (ls *languageServer) replayState() *replayState {
+	ls.Lock()
+	initParams := ls.initParams
+	ls.Unlock()
+	server.Lock()
+	defer server.Unlock()
+	if !server.initialized || initParams == nil {
+		return nil
+	}
+	// keep the original params, e.g. the intelephense storage and license
+	params := KeyValue{}
+	for k, v := range initParams {
+		params[k] = v
+	}
+	folders := []KeyValue{}
+	for name, uri := range server.openFolders {
+		folders = append(folders, KeyValue{"uri": uri, "name": name})
+	}
+	params["folders"] = folders
+	documents := map[string]document{}
+	for fn, doc := range server.documents {
+		if ls.handles(doc.languageId, fn) {
+			documents[fn] = *doc
+		}
+	}
+
+	return &replayState{params, documents}
+}
+
+// replay brings a restarted server to the state of the IDE before it handles
+// requests, the workspace folders are initialized again and the open documents
+// reopened. It returns false if the server exited in the meantime.
+func (ls *languageServer) replay(c *handler, state *replayState) bool {
+	Log("Replaying %d documents to %s", len(state.documents), ls.Name)
+	call := func(method string, params interface{}) bool {
+		body, _ := json.Marshal(params)
+		cb := make(kvChan, 1)
+		if !ls.dispatch(c, &mateRequest{Method: method, Body: body, CB: cb, ctx: context.Background()}) {
+			return false
+		}
+		if e, ok := resultError(<-cb); ok {
+			Log("Replaying %s to %s failed: %s", method, ls.Name, e.Message)
+		}
+		return true
+	}
+	if !call("initialize", state.initialize) {
+		return false
+	}
+	for fn, doc := range state.documents {
+		if !call("textDocument/didOpen", KeyValue{
+			"uri":        fn,
+			"languageId": doc.languageId,
+			"version":    doc.version,
+			"text":       doc.text,
+		}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// status reports whether the server is running and how often it was restarted.
+func (ls *languageServer) status() serverStatus {
+	ls.Lock()
+	defer ls.Unlock()
+	status := serverStatus{Name: ls.Name, Restarts: ls.restarts}
+	if ls.client != nil {
+		status.Running = true
+		status.Pid = ls.client.process.Pid
+	}
+
+	return status
+}
+
+// commands returns the commands the running server executes.
+func (ls *languageServer) commands() []string {
+	ls.Lock()
+	c := ls.client
+	ls.Unlock()
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	return c.commands
+}
+
+// workspaceFolders returns the folders of an initialize request, defaulting to dir.
+func workspaceFolders(params KeyValue, defaultName string) []lsp.WorkspaceFolder {
+	var folders []lsp.WorkspaceFolder
+	paramFolders := params.array("folders", []interface{}{})
+	if len(paramFolders) > 0 {
+		Log("folders: %d, %v", len(paramFolders), paramFolders)
+		for _, f := range paramFolders {
+			if m, ok := f.(map[string]interface{}); ok {
+				folder := KeyValue(m)
+				uri, _ := lsp.NewDocumentURIFromURL(folder.string("uri", ""))
+				folders = append(folders, lsp.WorkspaceFolder{
+					URI:  uri,
+					Name: folder.string("name", ""),
+				})
+			}
+		}
+	} else {
+		folders = append(folders, lsp.WorkspaceFolder{
+			URI:  lsp.NewDocumentURI(params.string("dir", "")),
+			Name: params.string("name", defaultName),
+		})
+	}
+
+	return folders
+}
+
+// processRequests serves requests until the server process exits. Requests are
+// handled concurrently by up to workers goroutines, methods that change the
+// state of the server are handled in order and before any later request.
+func (ls *languageServer) processRequests(c *handler) {
+	Log("%s is waiting for input", ls.Name)
+
+	workers := make(chan struct{}, ls.workers())
+	for {
+		var request *mateRequest
+		select {
+		case request = <-ls.in:
+		case <-c.done:
+			return
+		}
+		if config.EnableLogging {
+			Log("LSP <-- IDE %s %s %s %db", ls.Name, "request", request.Method, len(string(request.Body)))
+		}
+
+		if orderedMethods[request.Method] {
+			if !ls.dispatch(c, request) {
+				return
+			}
+			continue
+		}
+		select {
+		case workers <- struct{}{}:
+		case <-c.done:
+			request.CB <- errorResult(errBackendUnavailable, "%s exited", ls.Name)
+			return
+		}
+		go func(request *mateRequest) {
+			defer func() { <-workers }()
+			ls.dispatch(c, request)
+		}(request)
+	}
+}
+
+// orderedMethods must reach the server in the order they were sent, requests
+// that follow them depend on their effect.
+var orderedMethods = map[string]bool{
+	"initialize":                true,
+	"didChangeWorkspaceFolders": true,
+	"textDocument/didOpen":      true,
+	"textDocument/didChange":    true,
+	"textDocument/didClose":     true,
+}
+
+// defaultWorkers is the number of concurrent requests per server.
+const defaultWorkers = 4
+
+func (ls *languageServer) workers() int {
+	if ls.Workers > 0 {
+		return ls.Workers
+	}
+
+	return defaultWorkers
+}
+
+// dispatch handles a request and forwards the result, it returns false if the
+// server exited in the meantime.
+func (ls *languageServer) dispatch(c *handler, request *mateRequest) bool {
+	reply := make(kvChan, 1)
+	go ls.handle(c, &mateRequest{Method: request.Method, Body: request.Body, CB: reply, ctx: request.ctx})
+	select {
+	case result := <-reply:
+		request.CB <- result
+	case <-request.Context().Done():
+		// the LSP request is cancelled with the same context
+		request.CB <- contextError(request.Context())
+	case <-c.done:
+		request.CB <- errorResult(errBackendUnavailable, "%s exited", ls.Name)
+		return false
+	}
+
+	return true
+}
+
+func (ls *languageServer) handle(c *handler, request *mateRequest) {
+	defer catchAndLogPanic(func() {
+		request.CB <- errorResult(errInternal, "internal error")
+	})
+	ctx := request.Context()
+	lsc := c.lsc
+
+	switch request.Method {
+	case "initialize":
+		pid := os.Getpid()
+		var params KeyValue
+		if err := json.Unmarshal(request.Body, &params); err != nil {
+			request.CB <- badRequest(err)
+			return
+		}
+		folders := workspaceFolders(params, ls.Name+"Project")
+
+		options := lsp.KeyValue(ls.InitializationOptions)
+		if ls.initOptions != nil {
+			options = ls.initOptions(params)
+		}
+		if options == nil {
+			options = lsp.KeyValue{}
+		}
+
+		ctxC, cancel := context.WithTimeout(ctx, time.Second)
+		response, respErr, err := lsc.GetConnection().SendRequest(ctxC, "initialize", lsp.EncodeMessage(&lsp.InitializeParams{
+			ProcessID:             &pid,
+			InitializationOptions: options,
+			Capabilities: lsp.KeyValue{
+				"workspace": KeyValue{"workspaceFolders": true, "configuration": true},
+				"textDocument": KeyValue{
+					"publishDiagnostics": KeyValue{"versionSupport": true},
+					"diagnostic":         KeyValue{"relatedDocumentSupport": true},
+				},
+				"workspaceFolders": folders,
+				// servers report indexing as work done progress
+				"window": KeyValue{"workDoneProgress": true},
+			},
+			WorkspaceFolders: &folders,
+		}))
+		cancel()
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		// the capabilities of the library do not include pull diagnostics
+		result := struct {
+			Capabilities struct {
+				DiagnosticProvider     json.RawMessage `json:"diagnosticProvider"`
+				ExecuteCommandProvider struct {
+					Commands []string `json:"commands"`
+				} `json:"executeCommandProvider"`
+			} `json:"capabilities"`
+		}{}
+		if err := json.Unmarshal(response, &result); err != nil {
+			LogError(err)
+		}
+		ls.Lock()
+		if ls.initParams == nil {
+			ls.initParams = params
+		}
+		ls.Unlock()
+		provider := string(result.Capabilities.DiagnosticProvider)
+		c.Lock()
+		c.pullDiagnostics = len(provider) != 0 && provider != "null" && provider != "false"
+		c.commands = result.Capabilities.ExecuteCommandProvider.Commands
+		c.Unlock()
+		lsc.Initialized(&lsp.InitializedParams{})
+		if len(ls.Settings) != 0 {
+			lsc.WorkspaceDidChangeConfiguration(&lsp.DidChangeConfigurationParams{
+				Settings: lsp.KeyValue{ls.Name: ls.Settings},
+			})
+		}
+		request.CB <- &KeyValue{"status": "ok"}
+	case "textDocument/hover":
+		params := lsp.TextDocumentPositionParams{}
+		if err := json.Unmarshal(request.Body, &params); err != nil {
+			request.CB <- badRequest(err)
+			return
+		}
+		response, respErr, err := lsc.TextDocumentHover(ctx, &lsp.HoverParams{TextDocumentPositionParams: params})
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		request.CB <- &KeyValue{"status": "ok", "result": response}
+	case "didChangeWorkspaceFolders":
+		folder := lsp.WorkspaceFolder{}
+		if err := json.Unmarshal(request.Body, &folder); err != nil {
+			request.CB <- badRequest(err)
+			return
+		}
+		lsc.WorkspaceDidChangeWorkspaceFolders(&lsp.DidChangeWorkspaceFoldersParams{
+			Event: lsp.WorkspaceFoldersChangeEvent{
+				Added:   []lsp.WorkspaceFolder{folder},
+				Removed: []lsp.WorkspaceFolder{},
+			},
+		})
+		request.CB <- &KeyValue{"status": "ok"}
+	case "textDocument/definition":
+		fallthrough
+	case "textDocument/completion":
+		response, respErr, err := lsc.GetConnection().SendRequest(ctx, request.Method, request.Body)
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		request.CB <- &KeyValue{"status": "ok", "result": response}
+	case "textDocument/references", "textDocument/implementation",
+		"textDocument/typeDefinition", "textDocument/declaration":
+		response, respErr, err := lsc.GetConnection().SendRequest(ctx, request.Method, request.Body)
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		locations, err := normalizeLocations(response)
+		if err != nil {
+			request.CB <- errorResult(errBackendError, "%s", err)
+			return
+		}
+		request.CB <- &KeyValue{"status": "ok", "result": locations}
+	case "textDocument/formatting", "textDocument/rangeFormatting":
+		response, respErr, err := lsc.GetConnection().SendRequest(ctx, request.Method, request.Body)
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		edits := []lsp.TextEdit{}
+		if string(response) != "null" {
+			if err := json.Unmarshal(response, &edits); err != nil {
+				request.CB <- errorResult(errBackendError, "%s", err)
+				return
+			}
+		}
+		request.CB <- &KeyValue{"status": "ok", "result": edits}
+	case "textDocument/signatureHelp":
+		response, respErr, err := lsc.GetConnection().SendRequest(ctx, request.Method, request.Body)
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		if string(response) == "null" {
+			request.CB <- &KeyValue{"status": "ok", "result": nil}
+			return
+		}
+		help := lsp.SignatureHelp{}
+		if err := json.Unmarshal(response, &help); err != nil {
+			request.CB <- errorResult(errBackendError, "%s", err)
+			return
+		}
+		request.CB <- &KeyValue{"status": "ok", "result": newSignatureHelp(help)}
+	case "textDocument/codeAction":
+		var params KeyValue
+		if err := json.Unmarshal(request.Body, &params); err != nil {
+			request.CB <- badRequest(err)
+			return
+		}
+		if _, ok := params["context"]; !ok {
+			target := struct {
+				TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+				Range        lsp.Range                  `json:"range"`
+			}{}
+			if err := json.Unmarshal(request.Body, &target); err != nil {
+				request.CB <- badRequest(err)
+				return
+			}
+			params["context"] = KeyValue{"diagnostics": c.diagnosticsIn(target.TextDocument.URI.String(), target.Range)}
+		}
+		response, respErr, err := lsc.GetConnection().SendRequest(ctx, request.Method, lsp.EncodeMessage(params))
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		if string(response) == "null" {
+			response = json.RawMessage("[]")
+		}
+		request.CB <- &KeyValue{"status": "ok", "result": response}
+	case "executeCodeAction":
+		params := struct {
+			Action json.RawMessage `json:"action"`
+		}{}
+		if err := json.Unmarshal(request.Body, &params); err != nil || len(params.Action) == 0 {
+			request.CB <- errorResult(errBadRequest, "invalid action")
+			return
+		}
+		edits, err := c.executeCodeAction(ctx, params.Action)
+		if err != nil {
+			request.CB <- errorResult(errBackendError, "%s", err)
+			return
+		}
+		request.CB <- &KeyValue{"status": "ok", "result": edits}
+	case "textDocument/prepareRename":
+		response, respErr, err := lsc.GetConnection().SendRequest(ctx, request.Method, request.Body)
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		request.CB <- &KeyValue{"status": "ok", "result": response}
+	case "textDocument/rename":
+		// servers without prepareRename support answer with MethodNotFound
+		response, respErr, err := lsc.GetConnection().SendRequest(ctx, "textDocument/prepareRename", request.Body)
+		if err == nil && respErr == nil && string(response) == "null" {
+			request.CB <- errorResult(errBadRequest, "symbol can not be renamed")
+			return
+		} else if respErr != nil && respErr.Code != jsonrpc.ErrorCodesMethodNotFound {
+			request.CB <- backendError(ctx, respErr, nil)
+			return
+		}
+
+		response, respErr, err = lsc.GetConnection().SendRequest(ctx, request.Method, request.Body)
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		edit := workspaceEdit{}
+		if string(response) != "null" {
+			if err := json.Unmarshal(response, &edit); err != nil {
+				request.CB <- errorResult(errBackendError, "%s", err)
+				return
+			}
+		}
+		request.CB <- &KeyValue{"status": "ok", "result": edit}
+	case "documentSymbols":
+		response, respErr, err := lsc.GetConnection().SendRequest(ctx, "textDocument/documentSymbol", request.Body)
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		symbols, err := normalizeDocumentSymbols(response)
+		if err != nil {
+			request.CB <- errorResult(errBackendError, "%s", err)
+			return
+		}
+		request.CB <- &KeyValue{"status": "ok", "result": symbols}
+	case "workspace/symbol":
+		response, respErr, err := lsc.GetConnection().SendRequest(ctx, request.Method, request.Body)
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		symbols, err := normalizeWorkspaceSymbols(response, ls.Name)
+		if err != nil {
+			request.CB <- errorResult(errBackendError, "%s", err)
+			return
+		}
+		request.CB <- &KeyValue{"status": "ok", "result": symbols}
+	case "textDocument/diagnostic":
+		// pulls the diagnostics of a document into the store, servers without
+		// pull support publish them instead
+		params := textDocumentParam{}
+		if result := decodeRequest(request.Body, &params); result != nil {
+			request.CB <- result
+			return
+		}
+		c.Lock()
+		pull := c.pullDiagnostics
+		c.Unlock()
+		if !pull {
+			request.CB <- &KeyValue{"status": "ok"}
+			return
+		}
+		uri, err := lsp.NewDocumentURIFromURL(params.URI)
+		if err != nil {
+			request.CB <- badRequest(err)
+			return
+		}
+		previous, _ := store.get(uri.String(), ls.Name)
+		response, respErr, err := lsc.GetConnection().SendRequest(ctx, request.Method, lsp.EncodeMessage(struct {
+			TextDocument     lsp.TextDocumentIdentifier `json:"textDocument"`
+			PreviousResultID string                     `json:"previousResultId,omitempty"`
+		}{lsp.TextDocumentIdentifier{URI: uri}, previous.resultID}))
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		report := documentDiagnosticReport{}
+		if err := json.Unmarshal(response, &report); err != nil {
+			request.CB <- errorResult(errBackendError, "%s", err)
+			return
+		}
+		c.storeReport(uri, report)
+		for related, relatedReport := range report.RelatedDocuments {
+			if relatedURI, err := lsp.NewDocumentURIFromURL(related); err == nil {
+				c.storeReport(relatedURI, relatedReport)
+			}
+		}
+		request.CB <- &KeyValue{"status": "ok"}
+	case "raw":
+		// requests of the LSP front end are passed through unchanged
+		params := rawRequest{}
+		if result := decodeRequest(request.Body, &params); result != nil {
+			request.CB <- result
+			return
+		}
+		response, respErr, err := lsc.GetConnection().SendRequest(ctx, params.Method, params.Params)
+		if respErr != nil || err != nil {
+			request.CB <- backendError(ctx, respErr, err)
+			return
+		}
+		request.CB <- &KeyValue{"status": "ok", "result": response}
+	case "textDocument/documentSymbol":
+		// documentSymbol is only used to make the server publish diagnostics,
+		// which are then marked in the TextMate document identified by uuid.
+		var params KeyValue
+		if err := json.Unmarshal(request.Body, &params); err != nil {
+			LogError(err)
+		}
+		c.Lock()
+		c.Requests[params.string("fn", "")] = params.string("uuid", "")
+		c.Unlock()
+		request.CB <- &KeyValue{"status": "ok"}
+
+		go lsc.GetConnection().SendRequest(ctx, request.Method, request.Body)
+	case "textDocument/didOpen":
+		textDocument := &KeyValue{}
+		if err := json.Unmarshal(request.Body, textDocument); err != nil {
+			request.CB <- badRequest(err)
+			return
+		}
+		uri, _ := lsp.NewDocumentURIFromURL(textDocument.string("uri", ""))
+		lsc.TextDocumentDidOpen(&lsp.DidOpenTextDocumentParams{TextDocument: lsp.TextDocumentItem{
+			URI:        uri,
+			LanguageID: textDocument.string("languageId", ""),
+			Version:    int(textDocument.float64("version", 0)),
+			Text:       textDocument.string("text", ""),
+		}})
+		request.CB <- &KeyValue{"status": "ok"}
+	case "textDocument/didChange":
+		params := lsp.DidChangeTextDocumentParams{}
+		if err := json.Unmarshal(request.Body, &params); err != nil {
+			request.CB <- badRequest(err)
+			return
+		}
+		lsc.TextDocumentDidChange(&params)
+		request.CB <- &KeyValue{"status": "ok"}
+	case "textDocument/didClose":
+		textDocument := lsp.TextDocumentIdentifier{}
+		if err := json.Unmarshal(request.Body, &textDocument); err != nil {
+			request.CB <- badRequest(err)
+			return
+		}
+		lsc.TextDocumentDidClose(&lsp.DidCloseTextDocumentParams{TextDocument: textDocument})
+		request.CB <- &KeyValue{"status": "ok"}
+	default:
+		request.CB <- errorResult(errBadRequest, "unknown method %s", request.Method)
+	}
+}
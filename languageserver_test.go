@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/tectiv3/go-lsp"
+	"github.com/tectiv3/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// fakeServer is a language server that holds hover requests on line 0 until
+// release is closed and reports the notifications it receives.
+func fakeServer(t *testing.T, release chan struct{}) (*handler, chan string) {
+	t.Helper()
+	clientIn, serverOut := io.Pipe()
+	serverIn, clientOut := io.Pipe()
+	t.Cleanup(func() {
+		clientIn.Close()
+		serverIn.Close()
+	})
+
+	received := make(chan string, 16)
+	conn := jsonrpc.NewConnection(serverIn, serverOut,
+		func(ctx context.Context, logger jsonrpc.FunctionLogger, method string, params json.RawMessage, respond func(json.RawMessage, *jsonrpc.ResponseError)) {
+			var hover lsp.HoverParams
+			json.Unmarshal(params, &hover)
+			received <- fmt.Sprintf("%s %d", method, hover.Position.Line)
+			go func() {
+				if hover.Position.Line == 0 {
+					<-release
+				}
+				respond(json.RawMessage(`null`), nil)
+			}()
+		},
+		func(logger jsonrpc.FunctionLogger, method string, params json.RawMessage) {
+			var change lsp.DidChangeTextDocumentParams
+			json.Unmarshal(params, &change)
+			received <- fmt.Sprintf("%s %d", method, change.TextDocument.Version)
+		},
+		func(err error) {})
+	go conn.Run()
+
+	h := &handler{name: "fake", done: make(chan struct{})}
+	h.lsc = lsp.NewClient(clientIn, clientOut, h, func(err error) {})
+	go h.lsc.Run()
+
+	return h, received
+}
+
+func TestProcessRequestsOrdering(t *testing.T) {
+	release := make(chan struct{})
+	h, received := fakeServer(t, release)
+	ls := &languageServer{ServerConfig: ServerConfig{Name: "fake"}, in: make(mrChan)}
+	go ls.processRequests(h)
+	defer close(h.done)
+
+	send := func(method, body string) kvChan {
+		cb := make(kvChan, 1)
+		ls.in <- &mateRequest{Method: method, Body: json.RawMessage(body), CB: cb}
+		return cb
+	}
+	hover := func(line int) string {
+		return fmt.Sprintf(`{"textDocument":{"uri":"file:///a.go"},"position":{"line":%d,"character":0}}`, line)
+	}
+	change := func(version int) string {
+		return fmt.Sprintf(`{"textDocument":{"uri":"file:///a.go","version":%d},"contentChanges":[{"text":"x"}]}`, version)
+	}
+	next := func() string {
+		select {
+		case r := <-received:
+			return r
+		case <-time.After(time.Second):
+			t.Fatal("the server received nothing")
+			return ""
+		}
+	}
+
+	slow := send("textDocument/hover", hover(0))
+	if r := next(); r != "textDocument/hover 0" {
+		t.Fatalf("received %s", r)
+	}
+	// document changes are not held up by the pending hover and keep their order
+	send("textDocument/didChange", change(1))
+	send("textDocument/didChange", change(2))
+	fast := send("textDocument/hover", hover(1))
+	for _, want := range []string{"textDocument/didChange 1", "textDocument/didChange 2", "textDocument/hover 1"} {
+		if r := next(); r != want {
+			t.Errorf("received %s, want %s", r, want)
+		}
+	}
+
+	select {
+	case result := <-fast:
+		if (*result)["status"] != "ok" {
+			t.Errorf("hover failed: %v", *result)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hover waited for the pending one")
+	}
+	select {
+	case <-slow:
+		t.Fatal("pending hover was answered")
+	default:
+	}
+	close(release)
+	select {
+	case <-slow:
+	case <-time.After(time.Second):
+		t.Fatal("pending hover was not answered")
+	}
+}
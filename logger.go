@@ -267,6 +267,9 @@ func hiYellowString(format string, a ...interface{}) string {
 func hiBlueString(format string, a ...interface{}) string {
 	return colorFormat(format, FgHiBlue, a...)
 }
+func hiCyanString(format string, a ...interface{}) string {
+	return colorFormat(format, FgHiCyan, a...)
+}
 func redString(format string, a ...interface{}) string {
 	return colorFormat(format, FgRed, a...)
 }
@@ -276,6 +279,9 @@ func greenString(format string, a ...interface{}) string {
 func blueString(format string, a ...interface{}) string {
 	return colorFormat(format, FgBlue, a...)
 }
+func cyanString(format string, a ...interface{}) string {
+	return colorFormat(format, FgCyan, a...)
+}
 func colorFormat(format string, color int, a ...interface{}) string {
 	return c_format(color) + fmt.Sprintf(format, a...) + c_unformat()
 }
@@ -1,42 +1,116 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.bug.st/json"
 )
 
+// shutdownTimeout is how long language servers get to exit before they are killed.
+const shutdownTimeout = 5 * time.Second
+
 var logger = NewLSPFunctionLogger(hiMagentaString, "App")
 
 var config Config
 
 func main() {
-	// check for first argument, if it is present - use it as config path
-	if len(os.Args) > 1 {
-		configPath := os.Args[1]
-		readConfig(configPath)
-	} else {
-		readConfig("")
-	}
-	// start copilot LS
+	// print the API description for editor plugins
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(describeAPI())
+		return
+	}
+	// report the diagnostics of a project, e.g. in a pre-commit hook
+	if len(os.Args) > 1 && os.Args[1] == "problems" {
+		os.Exit(runProblems(os.Args[2:]))
+	}
+	// lsp-client [-stdio] [config path]
+	flags := flag.NewFlagSet("lsp-client", flag.ExitOnError)
+	stdio := flags.Bool("stdio", false, "serve LSP to the editor on stdin and stdout")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: lsp-client [-stdio] [config]\n       lsp-client problems [flags] <dir>\n       lsp-client schema")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	readConfig(flags.Arg(0))
+	if *stdio {
+		config.LSPListen = "stdio"
+	}
+	stdioMode := config.LSPListen == "stdio"
+	// start copilot LS, an editor on stdio owns stdin and stdout
 	copilotChan := make(mrChan, 2)
-	go startCopilot(copilotChan)
-	// start php intelephense LS
-	intelephenseChan := make(mrChan, 2)
-	go startIntelephense(intelephenseChan)
-	// start go LS
-	goplsChan := make(mrChan, 2)
-	go startGopls(goplsChan)
-
-	// start vue LS
-	volarChan := make(mrChan, 2)
-	go startVolar(volarChan)
-
-	// start webserver
-	go startServer(intelephenseChan, copilotChan, volarChan, goplsChan, config.Port)
-
-	// wait for ctrl-c
+	go startCopilot(copilotChan, !stdioMode)
+	// start intelephense, volar, gopls and the language servers from the config
+	backends := startLanguageServers()
+
+	// start webserver, every editor on stdio runs its own process
+	srv := startServer(copilotChan, backends, config.Port, stdioMode)
+	// start the LSP front end, a stdio session ends the process
+	var editorDone <-chan struct{}
+	if len(config.LSPListen) != 0 {
+		done, err := startLSPFrontend(config.LSPListen)
+		if err != nil {
+			LogError(err)
+		}
+		editorDone = done
+	}
+
+	// wait for ctrl-c, a termination signal or the end of the stdio session
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	select {
+	case sig := <-c:
+		Log("Received %s, shutting down", sig)
+	case <-editorDone:
+		Log("Editor exited, shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// stop accepting requests and stop every server in parallel
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Shutdown(ctx); err != nil {
+			LogError(err)
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stopServers(backends)
+	}()
+	if cClient != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cClient.shutdown(ctx)
+		}()
+	}
+	wg.Wait()
 	os.Exit(0)
 }
+
+// stopServers stops the language servers within shutdownTimeout.
+func stopServers(backends []*languageServer) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, ls := range backends {
+		wg.Add(1)
+		go func(ls *languageServer) {
+			defer wg.Done()
+			ls.stop(ctx)
+		}(ls)
+	}
+	wg.Wait()
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -14,17 +16,55 @@ import (
 )
 
 type Config struct {
-	NodePath            string `json:"node_path"`
-	CopilotPath         string `json:"copilot_path"`
-	VolarPath           string `json:"volar_path"`
-	GoplsPath           string `json:"gopls_path"`
-	IntelephensePath    string `json:"intelephense_path"`
-	IntelephenseLicense string `json:"intelephense_license"`
-	IntelephenseStorage string `json:"intelephense_storage"`
-	TsdkPath            string `json:"tsdk_path"`
-	MatePath            string `json:"mate_path"`
-	Port                string `json:"port"`
-	EnableLogging       bool   `json:"enable_logging"`
+	NodePath            string         `json:"node_path"`
+	CopilotPath         string         `json:"copilot_path"`
+	VolarPath           string         `json:"volar_path"`
+	GoplsPath           string         `json:"gopls_path"`
+	IntelephensePath    string         `json:"intelephense_path"`
+	IntelephenseLicense string         `json:"intelephense_license"`
+	IntelephenseStorage string         `json:"intelephense_storage"`
+	TsdkPath            string         `json:"tsdk_path"`
+	MatePath            string         `json:"mate_path"`
+	Port                string         `json:"port"`
+	EnableLogging       bool           `json:"enable_logging"`
+	Servers             []ServerConfig `json:"servers"`
+	// Format enables server side formatting per languageId.
+	Format map[string]bool `json:"format"`
+	// Timeouts in seconds per IDE method, "default" applies to all others.
+	Timeouts map[string]float64 `json:"timeouts"`
+	// LSPListen serves LSP to editors on "stdio", "tcp://host:port" or "unix:///path".
+	LSPListen string `json:"lsp_listen"`
+}
+
+// defaultTimeout applies when the config has no timeout for a method.
+const defaultTimeout = 10 * time.Second
+
+// timeout returns how long an IDE request of method may take.
+func (c Config) timeout(method string) time.Duration {
+	if seconds, ok := c.Timeouts[method]; ok && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if seconds, ok := c.Timeouts["default"]; ok && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	return defaultTimeout
+}
+
+// ServerConfig declares a language server backend. Servers listed in the config
+// are started next to the built-in ones and replace a built-in with the same name.
+type ServerConfig struct {
+	Name                  string   `json:"name"`
+	Command               string   `json:"command"`
+	Args                  []string `json:"args"`
+	LanguageIds           []string `json:"language_ids"`
+	FileGlobs             []string `json:"file_globs"`
+	InitializationOptions KeyValue `json:"initialization_options"`
+	Settings              KeyValue `json:"settings"`
+	// Notifications lists server specific notifications that should be accepted and ignored.
+	Notifications []string `json:"notifications"`
+	// Workers limits the number of concurrent requests to the server.
+	Workers int `json:"workers"`
 }
 
 type signInResponse struct {
@@ -46,31 +86,42 @@ type checkStatusResponse struct {
 	User   string `json:"user"`
 }
 
+// Completion is a Copilot suggestion, Text replaces Range and UUID identifies
+// the suggestion in telemetry.
 type Completion struct {
-	UUID  string `json:"uuid"`
-	Text  string `json:"text"`
-	Range struct {
-		Start struct {
-			Line      int `json:"line"`
-			Character int `json:"character"`
-		} `json:"start"`
-		End struct {
-			Line      int `json:"line"`
-			Character int `json:"character"`
-		} `json:"end"`
-	} `json:"range"`
-	DisplayText string `json:"displayText"`
-	Position    struct {
-		Line      int `json:"line"`
-		Character int `json:"character"`
-	} `json:"position"`
-	DocVersion int `json:"docVersion"`
+	UUID        string       `json:"uuid"`
+	Text        string       `json:"text"`
+	Range       lsp.Range    `json:"range"`
+	DisplayText string       `json:"displayText"`
+	Position    lsp.Position `json:"position"`
+	DocVersion  int          `json:"docVersion"`
 }
 
 type CompletionsResponse struct {
 	Completions []Completion `json:"completions"`
 }
 
+// location is a source range for the IDE, with a file path and 1-based lines and columns.
+type location struct {
+	Path      string `json:"path"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	EndLine   int    `json:"endLine"`
+	EndColumn int    `json:"endColumn"`
+}
+
+// signatureHelp is the active signature of a signatureHelp result for a tooltip,
+// Format is the markup kind of the documentation fields.
+type signatureHelp struct {
+	Label                  string `json:"label"`
+	Documentation          string `json:"documentation"`
+	ActiveParameter        string `json:"activeParameter"`
+	ParameterDocumentation string `json:"parameterDocumentation"`
+	Format                 string `json:"format"`
+	ActiveSignature        int    `json:"activeSignature"`
+	Signatures             int    `json:"signatures"`
+}
+
 // KeyValue is basic key:value struct
 type KeyValue map[string]interface{}
 
@@ -85,13 +136,17 @@ func (kv KeyValue) bool(name string, defaultValue bool) bool {
 	return defaultValue
 }
 
-// int returns the value of the given name, assuming the value is an int.
-// If the value isn't found or is not of the type, the defaultValue is returned.
+// int returns the value of the given name, assuming the value is an int or a
+// decoded JSON number. If the value isn't found or is not of the type, the
+// defaultValue is returned.
 func (kv KeyValue) int(name string, defaultValue int) int {
 	if v, found := kv[name]; found {
 		if castValue, is := v.(int); is {
 			return castValue
 		}
+		if castValue, is := v.(float64); is {
+			return int(castValue)
+		}
 	}
 	return defaultValue
 }
@@ -155,25 +210,66 @@ func (kv *KeyValue) Scan(value interface{}) error {
 	return json.Unmarshal(bytes, kv)
 }
 
+// didChangeRequest is the body of the didChange method. Text replaces the whole
+// document, Changes are applied as ranged edits in order.
+type didChangeRequest struct {
+	URI        string                               `json:"uri"`
+	LanguageId string                               `json:"languageId"`
+	Version    *int                                 `json:"version"`
+	Text       *string                              `json:"text"`
+	Changes    []lsp.TextDocumentContentChangeEvent `json:"changes"`
+}
+
 type mateRequest struct {
 	Method string
 	Body   json.RawMessage
 	CB     kvChan
+	// ctx is done when the IDE request timed out or the client went away
+	ctx context.Context
+}
+
+// Context returns the context of the IDE request.
+func (mr mateRequest) Context() context.Context {
+	if mr.ctx == nil {
+		return context.Background()
+	}
+
+	return mr.ctx
 }
 
 type mateServer struct {
-	copilot      mrChan
-	intelephense mrChan
-	volar        mrChan
-	gopls        mrChan
-	initialized  bool
-	logger       jsonrpc.Logger
-	openFiles    map[string]time.Time
-	currentWS    *workSpace
-	openFolders  map[string]lsp.DocumentURI
+	copilot mrChan
+	// copilotSync queues the document notifications for Copilot in order
+	copilotSync chan *mateRequest
+	backends    []*languageServer
+	initialized bool
+	logger      jsonrpc.Logger
+	openFiles   map[string]time.Time
+	documents   map[string]*document
+	currentWS   *workSpace
+	openFolders map[string]lsp.DocumentURI
+	// inflight are the coalesced requests by method and document
+	inflight   map[string]*inflightRequest
+	inflightMu sync.Mutex
 	sync.Mutex
 }
 
+// inflightRequest is a hover or completion request that is cancelled when a
+// newer request for the same document arrives.
+type inflightRequest struct {
+	cancel context.CancelCauseFunc
+}
+
+var errSuperseded = errors.New("superseded")
+
+// document is the last synced state of an open document, kept to reopen it
+// in a restarted language server.
+type document struct {
+	languageId string
+	text       string
+	version    int
+}
+
 type workSpace struct {
 	name string
 	uri  string
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/tectiv3/go-lsp"
+	"github.com/tectiv3/go-lsp/jsonrpc"
+	"go.bug.st/json"
+)
+
+// panelSolution is an alternative solution of the Copilot panel, Text
+// replaces Range.
+type panelSolution struct {
+	SolutionID  string    `json:"solutionId,omitempty"`
+	Text        string    `json:"completionText"`
+	DisplayText string    `json:"displayText"`
+	Range       lsp.Range `json:"range"`
+	Score       float64   `json:"score"`
+}
+
+// panel collects the solutions Copilot streams for a getPanelCompletions request.
+type panel struct {
+	solutions []panelSolution
+	// done is closed by PanelSolutionsDone, err is set if Copilot failed
+	done chan struct{}
+	err  error
+}
+
+var panels = struct {
+	byID   map[string]*panel
+	nextID int
+	sync.Mutex
+}{byID: map[string]*panel{}}
+
+// panelCompletions asks Copilot for panel solutions and returns them ranked by
+// score once all arrived, or the solutions collected when ctx ends.
+func (c *handler) panelCompletions(ctx context.Context, params copilotCompletionRequest) *KeyValue {
+	p := &panel{done: make(chan struct{})}
+	panels.Lock()
+	panels.nextID++
+	id := fmt.Sprintf("copilot:///panel/%d", panels.nextID)
+	panels.byID[id] = p
+	panels.Unlock()
+	defer func() {
+		panels.Lock()
+		delete(panels.byID, id)
+		panels.Unlock()
+	}()
+
+	ctx, cancel := replyContext(ctx)
+	defer cancel()
+	_, respErr, err := c.lsc.GetConnection().SendRequest(ctx, "getPanelCompletions", lsp.EncodeMessage(KeyValue{
+		"doc":     params.doc(),
+		"panelId": id,
+	}))
+	if respErr != nil || err != nil {
+		return backendError(ctx, respErr, err)
+	}
+
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		Log("Panel %s did not finish in time", id)
+	}
+
+	panels.Lock()
+	defer panels.Unlock()
+	if p.err != nil && len(p.solutions) == 0 {
+		return errorResult(errBackendError, "%s", p.err)
+	}
+
+	return &KeyValue{"status": "ok", "result": rankSolutions(p.solutions)}
+}
+
+// rankSolutions orders solutions by score and drops duplicates.
+func rankSolutions(solutions []panelSolution) []panelSolution {
+	sort.SliceStable(solutions, func(i, j int) bool { return solutions[i].Score > solutions[j].Score })
+	result := []panelSolution{}
+	seen := map[string]bool{}
+	for _, solution := range solutions {
+		if seen[solution.Text] {
+			continue
+		}
+		seen[solution.Text] = true
+		result = append(result, solution)
+	}
+
+	return result
+}
+
+func onPanelSolution(logger jsonrpc.FunctionLogger, params json.RawMessage) {
+	solution := struct {
+		PanelID string `json:"panelId"`
+		panelSolution
+	}{}
+	if err := json.Unmarshal(params, &solution); err != nil {
+		LogError(err)
+		return
+	}
+	panels.Lock()
+	defer panels.Unlock()
+	if p, ok := panels.byID[solution.PanelID]; ok {
+		p.solutions = append(p.solutions, solution.panelSolution)
+	}
+}
+
+func onPanelSolutionsDone(logger jsonrpc.FunctionLogger, params json.RawMessage) {
+	done := struct {
+		PanelID string `json:"panelId"`
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(params, &done); err != nil {
+		LogError(err)
+		return
+	}
+	panels.Lock()
+	defer panels.Unlock()
+	p, ok := panels.byID[done.PanelID]
+	if !ok {
+		return
+	}
+	if done.Status == "Error" {
+		p.err = fmt.Errorf("panel failed: %s", done.Message)
+	}
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+}
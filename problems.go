@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tectiv3/go-lsp"
+	"go.bug.st/json"
+)
+
+// defaultSettle is how long no diagnostics have to arrive before a workspace
+// report is considered complete.
+const defaultSettle = 2 * time.Second
+
+// skippedDirs are not opened for workspace diagnostics.
+var skippedDirs = map[string]bool{"node_modules": true, "vendor": true}
+
+// onWorkspaceDiagnostics reports the diagnostics of a workspace. With open set
+// every file a server handles is opened first, the report is taken once the
+// servers finished indexing and no diagnostics arrived for the settle period.
+func (s *mateServer) onWorkspaceDiagnostics(mr mateRequest, cb kvChan) {
+	params := workspaceDiagnosticsRequest{}
+	if result := decodeRequest(mr.Body, &params); result != nil {
+		cb <- result
+		return
+	}
+	name := params.Workspace
+	if len(name) == 0 {
+		s.Lock()
+		if s.currentWS != nil {
+			name = s.currentWS.name
+		}
+		s.Unlock()
+	}
+	folder, ok := s.workspaceURI(name)
+	if !ok {
+		cb <- decodeError(fieldError{"workspace", "unknown workspace " + name})
+		return
+	}
+
+	ctx, cancel := replyContext(mr.Context())
+	defer cancel()
+
+	var opened map[string]*languageServer
+	if params.Open {
+		uri, _ := lsp.NewDocumentURIFromURL(folder)
+		opened = s.openWorkspace(ctx, uri.AsPath().String())
+	}
+	for uri, ls := range opened {
+		s.sendLSPRequest(ctx, ls.in, "textDocument/diagnostic", textDocumentParam{uri})
+	}
+
+	settle := defaultSettle
+	if params.Settle > 0 {
+		settle = time.Duration(params.Settle * float64(time.Second))
+	}
+	waitForDiagnostics(ctx, folder, settle)
+	result := store.workspace(folder)
+
+	for uri, ls := range opened {
+		s.sendLSPRequest(context.Background(), ls.in, "textDocument/didClose", KeyValue{"uri": uri})
+	}
+	cb <- &KeyValue{"status": "ok", "result": result}
+}
+
+// openWorkspace opens the files below dir that a server handles and that are
+// not open in the IDE, it returns the opened documents by uri.
+func (s *mateServer) openWorkspace(ctx context.Context, dir string) map[string]*languageServer {
+	opened := map[string]*languageServer{}
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			if path != dir && (strings.HasPrefix(d.Name(), ".") || skippedDirs[d.Name()]) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ls := s.backendFor("", path)
+		if ls == nil {
+			return nil
+		}
+		uri := lsp.NewDocumentURI(path).String()
+		s.Lock()
+		_, open := s.documents[uri]
+		s.Unlock()
+		if open {
+			return nil
+		}
+		text, err := os.ReadFile(path)
+		if err != nil {
+			LogError(err)
+			return nil
+		}
+		s.sendLSPRequest(ctx, ls.in, "textDocument/didOpen", KeyValue{
+			"uri":        uri,
+			"languageId": languageIdOf(path),
+			"version":    1,
+			"text":       string(text),
+		})
+		opened[uri] = ls
+
+		return nil
+	})
+
+	return opened
+}
+
+// languageIdOf returns the LSP language identifier of a file.
+func languageIdOf(path string) string {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	switch ext {
+	case "js":
+		return "javascript"
+	case "ts":
+		return "typescript"
+	case "tsx":
+		return "typescriptreact"
+	}
+
+	return ext
+}
+
+// waitForDiagnostics returns once no server is busy and no diagnostics of the
+// folder arrived for settle, or when ctx is done.
+func waitForDiagnostics(ctx context.Context, folder string, settle time.Duration) {
+	sub := &subscriber{events: make(chan event, 64), folder: folder}
+	events.subscribe(sub)
+	defer events.unsubscribe(sub)
+
+	timer := time.NewTimer(settle)
+	defer timer.Stop()
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if e.Type != eventDiagnostics && e.Type != eventProgress {
+				continue
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(settle)
+		case <-timer.C:
+			if !events.busy() {
+				return
+			}
+			timer.Reset(settle)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runProblems implements "lsp-client problems <dir>", it prints the diagnostics
+// of all files in dir and returns the exit status, 1 if there are errors.
+func runProblems(args []string) int {
+	flags := flag.NewFlagSet("problems", flag.ExitOnError)
+	configPath := flags.String("config", "", "config file, defaults to config.json")
+	format := flags.String("format", "text", "output format: text, json or sarif")
+	timeout := flags.Duration("timeout", 5*time.Minute, "maximum time to wait for the servers")
+	settle := flags.Duration("settle", defaultSettle, "quiet period that ends the wait for diagnostics")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: lsp-client problems [flags] <dir>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || (*format != "text" && *format != "json" && *format != "sarif") {
+		flags.Usage()
+		return 2
+	}
+	dir, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		LogError(err)
+		return 2
+	}
+	readConfig(*configPath)
+
+	backends := startLanguageServers()
+	newServer(nil, backends)
+	defer stopServers(backends)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	call := func(method string, params interface{}) *KeyValue {
+		body, _ := json.Marshal(params)
+		cb := make(kvChan, 1)
+		server.processRequest(mateRequest{Method: method, Body: body, ctx: ctx}, cb)
+		return <-cb
+	}
+	name := filepath.Base(dir)
+	if result := call("initialize", initializeRequest{Dir: dir, Name: name}); resultFailed(result) {
+		return 2
+	}
+	result := call("workspaceDiagnostics", workspaceDiagnosticsRequest{
+		Workspace: name, Open: true, Settle: settle.Seconds(),
+	})
+	if resultFailed(result) {
+		return 2
+	}
+	problems, _ := (*result)["result"].([]fileDiagnostics)
+
+	switch *format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(problems)
+	case "sarif":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(sarifLog(dir, problems))
+	default:
+		printProblems(os.Stdout, dir, problems)
+	}
+
+	for _, p := range problems {
+		for _, d := range p.Diagnostics {
+			if isError(d) {
+				return 1
+			}
+		}
+	}
+
+	return 0
+}
+
+func resultFailed(result *KeyValue) bool {
+	if e, ok := resultError(result); ok {
+		LogError(fmt.Errorf("%s: %s", e.Code, e.Message))
+		return true
+	}
+
+	return false
+}
+
+// isError reports whether d is an error, diagnostics without a known severity
+// are errors.
+func isError(d lsp.Diagnostic) bool {
+	return severityName(d) == "error"
+}
+
+// severityName returns the compiler style name of the severity of d.
+func severityName(d lsp.Diagnostic) string {
+	switch d.Severity {
+	case lsp.DiagnosticSeverityWarning:
+		return "warning"
+	case lsp.DiagnosticSeverityInformation:
+		return "info"
+	case lsp.DiagnosticSeverityHint:
+		return "hint"
+	}
+
+	return "error"
+}
+
+// relativePath returns the path of uri relative to dir.
+func relativePath(dir, uri string) string {
+	docURI, err := lsp.NewDocumentURIFromURL(uri)
+	if err != nil {
+		return uri
+	}
+	path := docURI.AsPath().String()
+	if rel, err := filepath.Rel(dir, path); err == nil {
+		return rel
+	}
+
+	return path
+}
+
+// printProblems prints diagnostics as file:line:col: severity: message.
+func printProblems(w io.Writer, dir string, problems []fileDiagnostics) {
+	for _, p := range problems {
+		path := relativePath(dir, p.URI)
+		for _, d := range p.Diagnostics {
+			message := strings.ReplaceAll(d.Message, "\n", " ")
+			fmt.Fprintf(w, "%s:%d:%d: %s: %s\n", path, d.Range.Start.Line+1, d.Range.Start.Character+1, severityName(d), message)
+		}
+	}
+}
+
+// sarifLog converts diagnostics to a SARIF 2.1.0 log with a run per server.
+func sarifLog(dir string, problems []fileDiagnostics) KeyValue {
+	runs := []KeyValue{}
+	bySource := map[string][]KeyValue{}
+	sources := []string{}
+	for _, p := range problems {
+		path := filepath.ToSlash(relativePath(dir, p.URI))
+		for _, d := range p.Diagnostics {
+			level := "note"
+			if isError(d) {
+				level = "error"
+			} else if d.Severity == lsp.DiagnosticSeverityWarning {
+				level = "warning"
+			}
+			result := KeyValue{
+				"level":   level,
+				"message": KeyValue{"text": d.Message},
+				"locations": []KeyValue{{"physicalLocation": KeyValue{
+					"artifactLocation": KeyValue{"uri": path, "uriBaseId": "SRCROOT"},
+					"region": KeyValue{
+						"startLine":   d.Range.Start.Line + 1,
+						"startColumn": d.Range.Start.Character + 1,
+						"endLine":     d.Range.End.Line + 1,
+						"endColumn":   d.Range.End.Character + 1,
+					},
+				}}},
+			}
+			var code interface{}
+			if json.Unmarshal(d.Code, &code) == nil && code != nil {
+				result["ruleId"] = fmt.Sprint(code)
+			}
+			if _, ok := bySource[p.Source]; !ok {
+				sources = append(sources, p.Source)
+			}
+			bySource[p.Source] = append(bySource[p.Source], result)
+		}
+	}
+	for _, source := range sources {
+		runs = append(runs, KeyValue{
+			"tool":               KeyValue{"driver": KeyValue{"name": source}},
+			"originalUriBaseIds": KeyValue{"SRCROOT": KeyValue{"uri": lsp.NewDocumentURI(dir).String() + "/"}},
+			"results":            bySource[source],
+		})
+	}
+
+	return KeyValue{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs":    runs,
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tectiv3/go-lsp"
+	"go.bug.st/json"
+)
+
+func testProblems(t *testing.T) []fileDiagnostics {
+	t.Helper()
+	var diagnostics []lsp.Diagnostic
+	err := json.Unmarshal([]byte(`[
+		{"range":{"start":{"line":2,"character":4},"end":{"line":2,"character":9}},"severity":1,"code":"E1","message":"undefined: x"},
+		{"range":{"start":{"line":5,"character":0},"end":{"line":5,"character":1}},"severity":2,"code":12,"message":"unused\nvariable"},
+		{"range":{"start":{"line":7,"character":0},"end":{"line":7,"character":1}},"severity":4,"message":"hint"},
+		{"range":{"start":{"line":9,"character":0},"end":{"line":9,"character":1}},"message":"no severity"}
+	]`), &diagnostics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []fileDiagnostics{
+		{URI: "file:///ws/pkg/a.go", Source: "gopls", Diagnostics: diagnostics[:2]},
+		{URI: "file:///ws/b.go", Source: "lint", Diagnostics: diagnostics[2:]},
+	}
+}
+
+func TestPrintProblems(t *testing.T) {
+	var out bytes.Buffer
+	printProblems(&out, "/ws", testProblems(t))
+	want := "pkg/a.go:3:5: error: undefined: x\n" +
+		"pkg/a.go:6:1: warning: unused variable\n" +
+		"b.go:8:1: hint: hint\n" +
+		"b.go:10:1: error: no severity\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestSarifLog(t *testing.T) {
+	body, err := json.Marshal(sarifLog("/ws", testProblems(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			Tool struct {
+				Driver struct {
+					Name string `json:"name"`
+				} `json:"driver"`
+			} `json:"tool"`
+			OriginalURIBaseIDs map[string]struct {
+				URI string `json:"uri"`
+			} `json:"originalUriBaseIds"`
+			Results []struct {
+				Level     string `json:"level"`
+				RuleID    string `json:"ruleId"`
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct {
+							URI string `json:"uri"`
+						} `json:"artifactLocation"`
+						Region struct {
+							StartLine   int `json:"startLine"`
+							StartColumn int `json:"startColumn"`
+						} `json:"region"`
+					} `json:"physicalLocation"`
+				} `json:"locations"`
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	if err := json.Unmarshal(body, &log); err != nil {
+		t.Fatal(err)
+	}
+
+	if log.Version != "2.1.0" || len(log.Runs) != 2 {
+		t.Fatalf("unexpected log %s", body)
+	}
+	gopls, lint := log.Runs[0], log.Runs[1]
+	if gopls.Tool.Driver.Name != "gopls" || lint.Tool.Driver.Name != "lint" {
+		t.Errorf("runs %s, %s", gopls.Tool.Driver.Name, lint.Tool.Driver.Name)
+	}
+	if gopls.OriginalURIBaseIDs["SRCROOT"].URI != "file:///ws/" {
+		t.Errorf("base uri %v", gopls.OriginalURIBaseIDs)
+	}
+	first := gopls.Results[0]
+	location := first.Locations[0].PhysicalLocation
+	if first.Level != "error" || first.RuleID != "E1" || location.ArtifactLocation.URI != "pkg/a.go" ||
+		location.Region.StartLine != 3 || location.Region.StartColumn != 5 {
+		t.Errorf("unexpected result %+v", first)
+	}
+	if gopls.Results[1].Level != "warning" || gopls.Results[1].RuleID != "12" {
+		t.Errorf("unexpected result %+v", gopls.Results[1])
+	}
+	if lint.Results[0].Level != "note" || lint.Results[1].Level != "error" {
+		t.Errorf("levels %s, %s", lint.Results[0].Level, lint.Results[1].Level)
+	}
+}
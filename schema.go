@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/tectiv3/go-lsp"
+	"go.bug.st/json"
+)
+
+// schemaBuilder generates JSON Schemas from the API types, named structs are
+// collected in defs and referenced.
+type schemaBuilder struct {
+	defs map[string]KeyValue
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{defs: map[string]KeyValue{}}
+}
+
+var (
+	rawMessageType  = reflect.TypeOf(json.RawMessage{})
+	documentURIType = reflect.TypeOf(lsp.DocumentURI{})
+)
+
+func (b *schemaBuilder) schemaOf(v interface{}) KeyValue {
+	return b.schema(reflect.TypeOf(v))
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) KeyValue {
+	switch t {
+	case rawMessageType:
+		return KeyValue{}
+	case documentURIType:
+		return KeyValue{"type": "string", "format": "uri"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.schema(t.Elem())
+	case reflect.Interface:
+		return KeyValue{}
+	case reflect.String:
+		return KeyValue{"type": "string"}
+	case reflect.Bool:
+		return KeyValue{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return KeyValue{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return KeyValue{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return KeyValue{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		if t.Elem().Kind() == reflect.Interface {
+			return KeyValue{"type": "object"}
+		}
+		return KeyValue{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return b.object(t)
+		}
+		name := t.Name()
+		if _, ok := b.defs[name]; !ok {
+			// placeholder for recursive types
+			b.defs[name] = KeyValue{}
+			b.defs[name] = b.object(t)
+		}
+		return KeyValue{"$ref": "#/$defs/" + name}
+	}
+
+	return KeyValue{}
+}
+
+// object returns the schema of a struct, embedded structs are inlined.
+func (b *schemaBuilder) object(t reflect.Type) KeyValue {
+	properties := KeyValue{}
+	required := []string{}
+	b.fields(t, properties, &required)
+
+	schema := KeyValue{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+func (b *schemaBuilder) fields(t reflect.Type, properties KeyValue, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if f.Anonymous && len(name) == 0 {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				b.fields(ft, properties, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+		properties[name] = b.schema(f.Type)
+		for _, option := range strings.Split(options, ",") {
+			if option == "required" {
+				*required = append(*required, name)
+			}
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"runtime/debug"
+	"sync"
 	"time"
 
 	"github.com/tectiv3/go-lsp"
@@ -19,6 +22,10 @@ func (s *mateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Log("method: %s, length: %d %s", r.Method, r.ContentLength, r.URL.Path)
 
+	if r.Method == http.MethodGet && r.URL.Path == "/events" {
+		s.serveEvents(w, r)
+		return
+	}
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -26,185 +33,234 @@ func (s *mateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	decoder := json.NewDecoder(r.Body)
 	mr := mateRequest{}
-	err := decoder.Decode(&mr)
-	if err != nil {
-		LogError(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	resultChan := make(kvChan)
 	var result *KeyValue
-	tick := time.After(10 * time.Second)
-
-	go s.processRequest(mr, resultChan)
-
-	// block until result or timeout
-	select {
-	case <-tick:
-		w.WriteHeader(http.StatusGatewayTimeout)
-		w.Header().Set("Content-Type", "application/json")
-
-		s.logger.LogOutgoingResponse("", mr.Method, json.RawMessage(`{"result": "error", "message": "time out"}`), nil)
-		json.NewEncoder(w).Encode(KeyValue{"result": "error", "message": "time out"})
-		return
-	case result = <-resultChan:
-	}
-
-	if result == nil {
-		w.WriteHeader(http.StatusNoContent)
-		return
+	if err := decoder.Decode(&mr); err != nil {
+		LogError(err)
+		result = badRequest(err)
+	} else {
+		var ok bool
+		if result, ok = s.waitForResult(r, mr); !ok {
+			return
+		}
+		if result == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	if e, ok := resultError(result); ok {
+		w.WriteHeader(e.httpStatus())
+	}
 	tr, _ := json.Marshal(result)
 
 	s.logger.LogOutgoingResponse("", mr.Method, json.RawMessage(tr), nil)
 	json.NewEncoder(w).Encode(result)
 }
 
+// waitForResult processes the request until the result, a timeout or the
+// client disconnect, it returns false if the client is gone.
+func (s *mateServer) waitForResult(r *http.Request, mr mateRequest) (*KeyValue, bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), config.timeout(mr.Method))
+	defer cancel()
+	mr.ctx = ctx
+	// buffered, so a late result does not block the sender
+	resultChan := make(kvChan, 1)
+
+	go s.processRequest(mr, resultChan)
+
+	select {
+	case <-ctx.Done():
+		if r.Context().Err() != nil {
+			Log("%s: client disconnected", mr.Method)
+			return nil, false
+		}
+		return errorResult(errTimeout, "time out"), true
+	case result := <-resultChan:
+		return result, true
+	}
+}
+
 func (s *mateServer) processRequest(mr mateRequest, cb kvChan) {
-	defer s.handlePanic(mr)
+	defer s.handlePanic(mr, cb)
 	s.logger.LogIncomingRequest("", mr.Method, mr.Body)
 
-	if mr.Method != "initialize" && !s.initialized {
-		cb <- &KeyValue{"result": "error", "message": "not initialized"}
+	if mr.Method != "initialize" && mr.Method != "serverStatus" && mr.Method != "describe" && !s.initialized {
+		cb <- errorResult(errNotInitialized, "not initialized")
 		return
 	}
 
 	switch mr.Method {
-	case "hover":
-		//params := lsp.TextDocumentPositionParams{}
-		//if err := json.Unmarshal(mr.Body, &params); err != nil {
-		//  cb <- &KeyValue{"result": "error", "message": err.Error()}
-		//  return
-		//}
-		//s.requestAndWait("textDocument/hover", params, cb)
-		params := KeyValue{}
-		if err := json.Unmarshal(mr.Body, &params); err != nil {
-			cb <- &KeyValue{"result": "error", "message": err.Error()}
-			return
-		}
-		languageId := params.string("languageId", "")
-		var result *KeyValue
-		if languageId == "php" {
-			result = s.sendLSPRequest(s.intelephense, "textDocument/hover", params)
-		} else if languageId == "go" {
-			result = s.sendLSPRequest(s.gopls, "textDocument/hover", params)
-		} else {
-			result = s.sendLSPRequest(s.volar, "textDocument/hover", params)
+	case "serverStatus":
+		servers := []serverStatus{}
+		for _, ls := range s.backends {
+			servers = append(servers, ls.status())
 		}
-
-		cb <- result
+		cb <- &KeyValue{"status": "ok", "servers": servers}
+	case "describe":
+		cb <- &KeyValue{"status": "ok", "result": describeAPI()}
+	case "hover":
+		s.forwardLatest(mr, "textDocument/hover", cb)
 	case "completion":
-		//params := lsp.CompletionParams{}
-		//if err := json.Unmarshal(mr.Body, &params); err != nil {
-		//  cb <- &KeyValue{"result": "error", "message": err.Error()}
-		//  return
-		//}
-		//s.requestAndWait("textDocument/completion", params, cb)
-		params := KeyValue{}
-		if err := json.Unmarshal(mr.Body, &params); err != nil {
-			cb <- &KeyValue{"result": "error", "message": err.Error()}
-			return
-		}
-		languageId := params.string("languageId", "")
-		var result *KeyValue
-		if languageId == "php" {
-			result = s.sendLSPRequest(s.intelephense, "textDocument/completion", params)
-		} else if languageId == "go" {
-			result = s.sendLSPRequest(s.gopls, "textDocument/completion", params)
-		} else if languageId == "javascript" || languageId == "typescript" || languageId == "vue" {
-			result = s.sendLSPRequest(s.volar, "textDocument/completion", params)
-		}
+		s.forwardLatest(mr, "textDocument/completion", cb)
 		if config.EnableLogging {
 			Log("Sending completion response")
 		}
-		cb <- result
 	case "definition":
-		//params := lsp.TextDocumentPositionParams{}
-		//if err := json.Unmarshal(mr.Body, &params); err != nil {
-		//  cb <- &KeyValue{"result": "error", "message": err.Error()}
-		//  return
-		//}
-		//s.requestAndWait("textDocument/definition", params, cb)
-		params := KeyValue{}
-		if err := json.Unmarshal(mr.Body, &params); err != nil {
-			cb <- &KeyValue{"result": "error", "message": err.Error()}
+		s.forwardToBackend(mr, "textDocument/definition", &positionRequest{}, cb)
+		if config.EnableLogging {
+			Log("Sending definition response")
+		}
+
+	case "references":
+		params := referencesRequest{}
+		if result := decodeRequest(mr.Body, &params); result != nil {
+			cb <- result
 			return
 		}
-		languageId := params.string("languageId", "")
-		var result *KeyValue
-		if languageId == "php" {
-			result = s.sendLSPRequest(s.intelephense, "textDocument/definition", params)
-		} else if languageId == "go" {
-			result = s.sendLSPRequest(s.gopls, "textDocument/definition", params)
-		} else {
-			result = s.sendLSPRequest(s.volar, "textDocument/definition", params)
+		if len(params.Context) == 0 {
+			includeDeclaration := params.IncludeDeclaration == nil || *params.IncludeDeclaration
+			params.Context = lsp.EncodeMessage(KeyValue{"includeDeclaration": includeDeclaration})
 		}
-		if config.EnableLogging {
-			Log("Sending definition response")
+		cb <- s.requestBackend(mr.Context(), "textDocument/references", params)
+	case "implementation":
+		s.forwardToBackend(mr, "textDocument/implementation", &positionRequest{}, cb)
+	case "typeDefinition":
+		s.forwardToBackend(mr, "textDocument/typeDefinition", &positionRequest{}, cb)
+	case "declaration":
+		s.forwardToBackend(mr, "textDocument/declaration", &positionRequest{}, cb)
+	case "format":
+		s.onFormat(mr, "textDocument/formatting", cb)
+	case "formatRange":
+		s.onFormat(mr, "textDocument/rangeFormatting", cb)
+	case "signatureHelp":
+		s.forwardToBackend(mr, "textDocument/signatureHelp", &positionRequest{}, cb)
+	case "documentSymbols":
+		params := documentSymbolsRequest{}
+		if result := decodeRequest(mr.Body, &params); result != nil {
+			cb <- result
+			return
+		}
+		result := s.requestBackend(mr.Context(), "documentSymbols", params)
+		if symbols, ok := (*result)["result"].([]documentSymbol); ok && params.Flat {
+			(*result)["result"] = flattenSymbols(symbols)
 		}
 		cb <- result
+	case "workspaceSymbol":
+		s.onWorkspaceSymbol(mr, cb)
+	case "diagnostics":
+		s.onDiagnostics(mr, cb)
+	case "workspaceDiagnostics":
+		s.onWorkspaceDiagnostics(mr, cb)
+	case "codeAction":
+		s.forwardToBackend(mr, "textDocument/codeAction", &codeActionRequest{}, cb)
+	case "executeCodeAction":
+		s.onExecuteCodeAction(mr, cb)
+	case "prepareRename":
+		s.forwardToBackend(mr, "textDocument/prepareRename", &positionRequest{}, cb)
+	case "rename":
+		s.onRename(mr, cb)
 
 	case "initialize":
 		s.onInitialize(mr, cb)
 	case "didOpen":
 		s.onDidOpen(mr, cb)
+	case "didChange":
+		s.onDidChange(mr, cb)
 	case "didClose":
 		s.onDidClose(mr, cb)
-	case "getCompletions":
-		params := KeyValue{}
-		if err := json.Unmarshal(mr.Body, &params); err != nil {
-			cb <- &KeyValue{"result": "error", "message": err.Error()}
+	case "getCompletions", "getPanelCompletions":
+		params := copilotCompletionRequest{}
+		if result := decodeRequest(mr.Body, &params); result != nil {
+			cb <- result
 			return
 		}
-		result := s.sendLSPRequest(s.copilot, "getCompletions", params)
+		if params.Version == nil {
+			version := s.documentVersion(params.URI)
+			params.Version = &version
+		}
+		result := s.sendLSPRequest(mr.Context(), s.copilot, mr.Method, params)
 
 		if config.EnableLogging {
 			Log("Sending copilot completions")
 		}
 		cb <- result
-	case "getCompletionsCycling":
-		params := KeyValue{}
-		result := s.sendLSPRequest(s.copilot, "getCompletionsCycling", params)
+	case "inlineCompletion":
+		params := inlineCompletionRequest{}
+		if result := decodeRequest(mr.Body, &params); result != nil {
+			cb <- result
+			return
+		}
+		if params.Version == nil {
+			version := s.documentVersion(params.URI)
+			params.Version = &version
+		}
+		cb <- s.sendLSPRequest(mr.Context(), s.copilot, "inlineCompletion", params)
+	case "getCompletionsCycling", "nextCompletion", "previousCompletion", "acceptCompletion", "dismissCompletion":
+		params := suggestionRequest{}
+		if result := decodeRequest(mr.Body, &params); result != nil {
+			cb <- result
+			return
+		}
+		result := s.sendLSPRequest(mr.Context(), s.copilot, mr.Method, params)
 
 		if config.EnableLogging {
-			Log("Sending copilot completions cycling")
+			Log("Sending copilot %s", mr.Method)
 		}
 		cb <- result
+	case "copilotChat":
+		params := copilotChatRequest{}
+		if result := decodeRequest(mr.Body, &params); result != nil {
+			cb <- result
+			return
+		}
+		cb <- s.sendLSPRequest(mr.Context(), s.copilot, mr.Method, params)
+	case "notifyCompletionAccepted":
+		params := completionAcceptedRequest{}
+		if result := decodeRequest(mr.Body, &params); result != nil {
+			cb <- result
+			return
+		}
+		cb <- s.sendLSPRequest(mr.Context(), s.copilot, mr.Method, params)
+	case "notifyCompletionRejected":
+		params := completionRejectedRequest{}
+		if result := decodeRequest(mr.Body, &params); result != nil {
+			cb <- result
+			return
+		}
+		cb <- s.sendLSPRequest(mr.Context(), s.copilot, mr.Method, params)
 	case "signIn":
-		result := s.sendLSPRequest(s.copilot, "signIn", KeyValue{})
+		result := s.sendLSPRequest(mr.Context(), s.copilot, "signIn", KeyValue{})
 		if config.EnableLogging {
 			Log("Sending copilot signIn")
 		}
 		cb <- result
 	case "signInConfirm":
-		params := KeyValue{}
-		if err := json.Unmarshal(mr.Body, &params); err != nil {
-			cb <- &KeyValue{"result": "error", "message": err.Error()}
+		params := signInConfirmRequest{}
+		if result := decodeRequest(mr.Body, &params); result != nil {
+			cb <- result
 			return
 		}
-		result := s.sendLSPRequest(s.copilot, "signInConfirm", params)
+		result := s.sendLSPRequest(mr.Context(), s.copilot, "signInConfirm", params)
 		if config.EnableLogging {
 			Log("Sending copilot signInConfirm")
 		}
 		cb <- result
 	case "checkStatus":
-		result := s.sendLSPRequest(s.copilot, "checkStatus", KeyValue{})
+		result := s.sendLSPRequest(mr.Context(), s.copilot, "checkStatus", KeyValue{})
 		if config.EnableLogging {
 			Log("Sending copilot checkStatus")
 		}
 		cb <- result
 	case "authStatus":
 		// This is an alias for checkStatus for convenience
-		result := s.sendLSPRequest(s.copilot, "checkStatus", KeyValue{})
+		result := s.sendLSPRequest(mr.Context(), s.copilot, "checkStatus", KeyValue{})
 		if config.EnableLogging {
 			Log("Sending copilot authStatus")
 		}
 		cb <- result
 	default:
-		cb <- &KeyValue{"result": "error", "message": "unknown method"}
+		cb <- errorResult(errBadRequest, "unknown method %s", mr.Method)
 	}
 	if config.EnableLogging {
 		Log("method: %s %s", mr.Method, "processRequest finished")
@@ -215,68 +271,63 @@ func (s *mateServer) onDidOpen(mr mateRequest, cb kvChan) {
 	s.Lock()
 	defer s.Unlock()
 	if !s.initialized {
-		cb <- &KeyValue{"result": "error", "message": "not initialized"}
+		cb <- errorResult(errNotInitialized, "not initialized")
 		return
 	}
 
-	params := KeyValue{}
-	if err := json.Unmarshal(mr.Body, &params); err != nil {
-		cb <- &KeyValue{"result": "error", "message": err.Error()}
-		return
-	}
-
-	fn := params.string("uri", "")
-	languageId := params.string("languageId", "")
-	if len(fn) == 0 {
-		cb <- &KeyValue{"result": "error", "message": "Invalid document uri"}
+	params := didOpenRequest{}
+	if result := decodeRequest(mr.Body, &params); result != nil {
+		cb <- result
 		return
 	}
+	fn := documentKey(params.URI)
+	languageId := params.LanguageId
 
-	cb <- &KeyValue{"result": "ok"}
+	cb <- &KeyValue{"status": "ok"}
 	//if _, ok := s.openFiles[fn]; ok {
 	//Log("file %s already opened", fn)
-	//s.sendLSPRequest(s.intelephense, "textDocument/didClose", KeyValue{
+	//s.sendLSPRequest(context.Background(), s.intelephense, "textDocument/didClose", KeyValue{
 	//  "uri": fn,
 	//})
 	//time.Sleep(100 * time.Millisecond)
 	//}
 	s.openFiles[fn] = time.Now()
+	params.Version = s.nextVersion(fn, params.Version)
+	s.documents[fn].languageId = languageId
+	s.documents[fn].text = params.Text
 	// sort slice and remove items if there are over 20 of them
 	if len(s.openFiles) > 19 {
 		// Log("openFiles: %v", s.openFiles)
 		for k, v := range s.openFiles {
 			if time.Since(v).Seconds() > 60 {
 				Log("Removing %s from openFiles", k)
+				evictedLanguage := ""
+				if doc, ok := s.documents[k]; ok {
+					evictedLanguage = doc.languageId
+				}
 				delete(s.openFiles, k)
-				s.sendLSPRequest(s.intelephense, "textDocument/didClose", KeyValue{
-					"uri": k,
-				})
-				s.sendLSPRequest(s.volar, "textDocument/didClose", KeyValue{
-					"uri": k,
-				})
-				s.sendLSPRequest(s.copilot, "textDocument/didClose", KeyValue{
-					"uri": k,
-				})
+				delete(s.documents, k)
+				if ls := s.backendFor(evictedLanguage, k); ls != nil {
+					s.sendLSPRequest(context.Background(), ls.in, "textDocument/didClose", KeyValue{
+						"uri": k,
+					})
+				}
+				s.syncCopilot("textDocument/didClose", KeyValue{"uri": k})
 			}
 		}
 	}
 
-	go s.sendLSPRequest(s.copilot, "textDocument/didOpen", params)
+	s.syncCopilot("textDocument/didOpen", params)
 
-	var ch mrChan
-	if languageId == "vue" || languageId == "js" || languageId == "ts" || languageId == "tsx" {
-		ch = s.volar
-	} else if languageId == "php" {
-		ch = s.intelephense
-	} else if languageId == "go" {
-		ch = s.gopls
+	ls := s.backendFor(languageId, fn)
+	if ls == nil {
+		return
 	}
-	s.sendLSPRequest(ch, "textDocument/didOpen", params)
+	s.sendLSPRequest(context.Background(), ls.in, "textDocument/didOpen", params)
 
-	uuid := params.string("uuid", "")
-	go s.sendLSPRequest(ch, "textDocument/documentSymbol", KeyValue{
+	go s.sendLSPRequest(context.Background(), ls.in, "textDocument/documentSymbol", KeyValue{
 		"textDocument": KeyValue{"uri": fn},
-		"uuid":         uuid,
+		"uuid":         params.UUID,
 		"fn":           fn,
 	})
 	// if diagnostics != nil {
@@ -293,28 +344,347 @@ func (s *mateServer) onDidOpen(mr mateRequest, cb kvChan) {
 func (s *mateServer) onDidClose(mr mateRequest, cb kvChan) {
 	s.Lock()
 	defer s.Unlock()
-	params := KeyValue{}
-	if err := json.Unmarshal(mr.Body, &params); err != nil {
-		cb <- &KeyValue{"result": "error", "message": err.Error()}
+	params := didCloseRequest{}
+	if result := decodeRequest(mr.Body, &params); result != nil {
+		cb <- result
 		return
 	}
-	fn := params.string("uri", "")
-	if len(fn) == 0 {
-		cb <- &KeyValue{"result": "error", "message": "Invalid document uri"}
-		return
+	fn := documentKey(params.URI)
+	if ls := s.backendFor(params.LanguageId, fn); ls != nil {
+		s.sendLSPRequest(context.Background(), ls.in, "textDocument/didClose", KeyValue{
+			"uri": fn,
+		})
 	}
-	go s.sendLSPRequest(s.intelephense, "textDocument/didClose", KeyValue{
-		"uri": fn,
-	})
-	go s.sendLSPRequest(s.volar, "textDocument/didClose", KeyValue{
-		"uri": fn,
-	})
-	go s.sendLSPRequest(s.copilot, "textDocument/didClose", KeyValue{
-		"uri": fn,
-	})
+	s.syncCopilot("textDocument/didClose", KeyValue{"uri": fn})
 	delete(s.openFiles, fn)
+	delete(s.documents, fn)
+
+	cb <- &KeyValue{"status": "ok"}
+}
+
+func (s *mateServer) onDidChange(mr mateRequest, cb kvChan) {
+	s.Lock()
+	defer s.Unlock()
+	params := didChangeRequest{}
+	if result := decodeRequest(mr.Body, &params); result != nil {
+		cb <- result
+		return
+	}
+	fn := documentKey(params.URI)
+	if _, ok := s.openFiles[fn]; !ok {
+		cb <- errorResult(errBadRequest, "document is not open")
+		return
+	}
+
+	changes := params.Changes
+	if params.Text != nil {
+		changes = []lsp.TextDocumentContentChangeEvent{{Text: *params.Text}}
+	}
+
+	version := 0
+	if params.Version != nil {
+		version = *params.Version
+	}
+	version = s.nextVersion(fn, version)
+	s.openFiles[fn] = time.Now()
+	s.documents[fn].update(changes)
+
+	change := KeyValue{
+		"textDocument":   KeyValue{"uri": fn, "version": version},
+		"contentChanges": changes,
+	}
+	s.syncCopilot("textDocument/didChange", change)
+	if ls := s.backendFor(params.LanguageId, fn); ls != nil {
+		s.sendLSPRequest(context.Background(), ls.in, "textDocument/didChange", change)
+	}
+
+	cb <- &KeyValue{"status": "ok", "version": version}
+}
+
+// onRename asks the language server for a rename edit. With apply set the edit
+// is written to every file that is not open in the IDE, edits of open documents
+// are returned so the IDE can apply them to its buffers.
+func (s *mateServer) onRename(mr mateRequest, cb kvChan) {
+	params := renameRequest{}
+	if result := decodeRequest(mr.Body, &params); result != nil {
+		cb <- result
+		return
+	}
+
+	result := s.requestBackend(mr.Context(), "textDocument/rename", params)
+	edit, ok := (*result)["result"].(workspaceEdit)
+	if !ok || !params.Apply {
+		cb <- result
+		return
+	}
+
+	files, err := edit.files()
+	if err != nil {
+		cb <- errorResult(errBackendError, "%s", err)
+		return
+	}
+	cb <- s.applyEdits(files)
+}
+
+// onDiagnostics returns the stored diagnostics of a document, a workspace or
+// of all documents. The diagnostics of a document are pulled first if its
+// server supports it.
+func (s *mateServer) onDiagnostics(mr mateRequest, cb kvChan) {
+	params := diagnosticsRequest{}
+	if result := decodeRequest(mr.Body, &params); result != nil {
+		cb <- result
+		return
+	}
+
+	if len(params.URI) != 0 {
+		uri, err := lsp.NewDocumentURIFromURL(params.URI)
+		if err != nil {
+			cb <- decodeError(fieldError{"uri", err.Error()})
+			return
+		}
+		if ls := s.backendFor(params.LanguageId, params.URI); ls != nil {
+			result := s.sendLSPRequest(mr.Context(), ls.in, "textDocument/diagnostic", textDocumentParam{params.URI})
+			if e, ok := resultError(result); ok {
+				// the published diagnostics are still returned
+				Log("textDocument/diagnostic failed for %s: %s", ls.Name, e.Message)
+			}
+		}
+		cb <- &KeyValue{"status": "ok", "result": store.document(uri.String())}
+		return
+	}
+
+	folder := ""
+	if len(params.Workspace) != 0 {
+		var ok bool
+		if folder, ok = s.workspaceURI(params.Workspace); !ok {
+			cb <- decodeError(fieldError{"workspace", "unknown workspace " + params.Workspace})
+			return
+		}
+	}
+	cb <- &KeyValue{"status": "ok", "result": store.workspace(folder)}
+}
+
+// workspaceURI returns the uri of an open workspace folder by name.
+func (s *mateServer) workspaceURI(name string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	folder, ok := s.openFolders[name]
+	if !ok {
+		return "", false
+	}
+
+	return folder.String(), true
+}
+
+// onWorkspaceSymbol sends the query to every language server and merges the results.
+func (s *mateServer) onWorkspaceSymbol(mr mateRequest, cb kvChan) {
+	params := workspaceSymbolRequest{}
+	if result := decodeRequest(mr.Body, &params); result != nil {
+		cb <- result
+		return
+	}
+	query := params.Query
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	symbols := []workspaceSymbol{}
+	for _, ls := range s.backends {
+		wg.Add(1)
+		go func(ls *languageServer) {
+			defer wg.Done()
+			result := s.sendLSPRequest(mr.Context(), ls.in, "workspace/symbol", KeyValue{"query": query})
+			found, ok := (*result)["result"].([]workspaceSymbol)
+			if !ok {
+				Log("workspace/symbol failed for %s: %v", ls.Name, *result)
+				return
+			}
+			mu.Lock()
+			symbols = append(symbols, found...)
+			mu.Unlock()
+		}(ls)
+	}
+	wg.Wait()
+
+	dir := ""
+	s.Lock()
+	if s.currentWS != nil {
+		dir = s.currentWS.uri
+	}
+	s.Unlock()
+
+	symbols = rankWorkspaceSymbols(symbols, query, dir)
+	if params.Limit > 0 && len(symbols) > params.Limit {
+		symbols = symbols[:params.Limit]
+	}
+
+	cb <- &KeyValue{"status": "ok", "result": symbols}
+}
+
+// onExecuteCodeAction runs a code action returned by codeAction. The edits are
+// returned by file, or with apply set handled like the edits of a rename.
+func (s *mateServer) onExecuteCodeAction(mr mateRequest, cb kvChan) {
+	params := executeCodeActionRequest{}
+	if result := decodeRequest(mr.Body, &params); result != nil {
+		cb <- result
+		return
+	}
+
+	result := s.requestBackend(mr.Context(), "executeCodeAction", params)
+	edits, ok := (*result)["result"].([]workspaceEdit)
+	if !ok {
+		cb <- result
+		return
+	}
+	files := []fileEdits{}
+	for _, edit := range edits {
+		f, err := edit.files()
+		if err != nil {
+			cb <- errorResult(errBackendError, "%s", err)
+			return
+		}
+		files = append(files, f...)
+	}
+	if !params.Apply {
+		cb <- &KeyValue{"status": "ok", "result": files}
+		return
+	}
+
+	cb <- s.applyEdits(files)
+}
+
+// applyEdits writes the edits of files that are not open in the IDE to disk
+// and returns the edits of open documents, which need to be reloaded.
+func (s *mateServer) applyEdits(files []fileEdits) *KeyValue {
+	closed := []fileEdits{}
+	reload := []fileEdits{}
+	for _, f := range files {
+		if s.isOpen(f.Path) {
+			reload = append(reload, f)
+		} else {
+			closed = append(closed, f)
+		}
+	}
+	applied, err := applyFileEdits(closed)
+	if err != nil {
+		LogError(err)
+		result := errorResult(errInternal, "%s", err)
+		(*result)["applied"] = applied
+		return result
+	}
 
-	cb <- &KeyValue{"result": "ok"}
+	return &KeyValue{"status": "ok", "applied": applied, "reload": reload}
+}
+
+// onFormat formats a document or range with the language server. When the
+// document text is sent along the formatted text is returned with the edits.
+func (s *mateServer) onFormat(mr mateRequest, method string, cb kvChan) {
+	params := formatRequest{}
+	if result := decodeRequest(mr.Body, &params); result != nil {
+		cb <- result
+		return
+	}
+	if method == "textDocument/rangeFormatting" && params.Range == nil {
+		cb <- decodeError(fieldError{"range", "is required"})
+		return
+	}
+	// requests routed by uri use the language of the document
+	languageId, uri := params.document()
+	if len(languageId) == 0 {
+		languageId = s.documentLanguage(uri)
+	}
+	if len(languageId) == 0 {
+		languageId = languageIdOf(uri)
+	}
+	if !config.Format[languageId] {
+		cb <- errorResult(errBadRequest, "formatting is disabled for %s", languageId)
+		return
+	}
+	if params.Options == nil {
+		tabSize := params.TabSize
+		if tabSize == 0 {
+			tabSize = 4
+		}
+		params.Options = KeyValue{
+			"tabSize":      tabSize,
+			"insertSpaces": params.InsertSpaces == nil || *params.InsertSpaces,
+		}
+	}
+
+	result := s.requestBackend(mr.Context(), method, params)
+	edits, ok := (*result)["result"].([]lsp.TextEdit)
+	if !ok || params.Text == nil {
+		cb <- result
+		return
+	}
+	text, err := applyTextEdits(*params.Text, edits)
+	if err != nil {
+		cb <- errorResult(errBackendError, "%s", err)
+		return
+	}
+
+	cb <- &KeyValue{"status": "ok", "result": edits, "text": text}
+}
+
+// isOpen reports whether the file at path is open in the IDE.
+func (s *mateServer) isOpen(path string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.openFiles[documentKey(path)]
+
+	return ok
+}
+
+// documentLanguage returns the languageId an open document was opened with.
+func (s *mateServer) documentLanguage(uri string) string {
+	s.Lock()
+	defer s.Unlock()
+	if doc, ok := s.documents[documentKey(uri)]; ok {
+		return doc.languageId
+	}
+
+	return ""
+}
+
+// documentVersion returns the last synced version of a document given by uri or path.
+func (s *mateServer) documentVersion(fn string) int {
+	s.Lock()
+	defer s.Unlock()
+	if doc, ok := s.documents[documentKey(fn)]; ok {
+		return doc.version
+	}
+
+	return 0
+}
+
+// nextVersion stores and returns the version of a document, servers
+// require versions to increase with every change.
+func (s *mateServer) nextVersion(fn string, version int) int {
+	doc, ok := s.documents[fn]
+	if !ok {
+		doc = &document{}
+		s.documents[fn] = doc
+	} else if version <= doc.version {
+		version = doc.version + 1
+	}
+	doc.version = version
+
+	return version
+}
+
+// update applies content changes in order, a change without range replaces the text.
+func (d *document) update(changes []lsp.TextDocumentContentChangeEvent) {
+	for _, change := range changes {
+		if change.Range == nil {
+			d.text = change.Text
+			continue
+		}
+		text, err := applyTextEdits(d.text, []lsp.TextEdit{{Range: *change.Range, NewText: change.Text}})
+		if err != nil {
+			LogError(err)
+			return
+		}
+		d.text = text
+	}
 }
 
 func (s *mateServer) onInitialize(mr mateRequest, cb kvChan) {
@@ -322,94 +692,247 @@ func (s *mateServer) onInitialize(mr mateRequest, cb kvChan) {
 	defer s.Unlock()
 	// initialize copilot
 	go func() {
-		if s.initialized {
+		if s.initialized || s.copilot == nil {
 			return
 		}
-		s.sendLSPRequest(s.copilot, "initialize", KeyValue{})
+		s.sendLSPRequest(context.Background(), s.copilot, "initialize", KeyValue{})
 		// Authentication is now handled during copilot startup
 	}()
 
-	params := KeyValue{}
-	if err := json.Unmarshal(mr.Body, &params); err != nil {
-		cb <- &KeyValue{"result": "error", "message": err.Error()}
-		return
-	}
-	dir := params.string("dir", "")
-	if len(dir) == 0 {
-		cb <- &KeyValue{"result": "error", "message": "Empty dir"}
+	params := initializeRequest{}
+	if result := decodeRequest(mr.Body, &params); result != nil {
+		cb <- result
 		return
 	}
-	languageId := params.string("languageId", "")
+	dir := params.Dir
 
-	name := params.string("name", "unknown")
+	name := params.Name
+	if len(name) == 0 {
+		name = "unknown"
+	}
 	if s.currentWS != nil && s.currentWS.name == name {
-		cb <- &KeyValue{"result": "ok", "message": "already initialized"}
+		cb <- &KeyValue{"status": "ok", "message": "already initialized"}
 		return
 	}
 
 	if !s.initialized {
-		// initialize intelephense
-		s.sendLSPRequest(s.intelephense, "initialize", params)
-		s.sendLSPRequest(s.volar, "initialize", params)
-		s.sendLSPRequest(s.gopls, "initialize", params)
+		for _, ls := range s.backends {
+			s.sendLSPRequest(context.Background(), ls.in, "initialize", params)
+		}
 		s.initialized = true
 		s.openFolders[name] = lsp.NewDocumentURI(dir)
 	} else if _, ok := s.openFolders[name]; !ok {
 		Log("First time opening workspace %s", name)
 		s.openFolders[name] = lsp.NewDocumentURI(dir)
-		if languageId == "php" {
-			params["folders"] = []KeyValue{{"uri": lsp.NewDocumentURI(dir), "name": name}}
-			s.sendLSPRequest(s.intelephense, "initialize", params)
+		// servers are initialized once, every server learns the workspace as
+		// projects mix languages
+		for _, ls := range s.backends {
+			s.sendLSPRequest(context.Background(), ls.in, "didChangeWorkspaceFolders", KeyValue{
+				"uri":  lsp.NewDocumentURI(dir),
+				"name": name,
+			})
 		}
-		// params["folders"] = []KeyValue{}
-		// for f, v := range s.openFolders {
-		//     params["folders"] = append(params["folders"].([]KeyValue), KeyValue{"uri": v, "name": f})
-		// }
-		s.sendLSPRequest(s.volar, "initialize", params)
-		s.sendLSPRequest(s.gopls, "initialize", params)
 	}
 
-	//go s.sendLSPRequest(s.intelephense, "didChangeWorkspaceFolders", KeyValue{
-	//  "uri":  s.openFolders[name],
-	//  "name": name,
-	//})
 	s.currentWS = &workSpace{name, dir}
-	cb <- &KeyValue{"result": "ok"}
+	cb <- &KeyValue{"status": "ok"}
+}
+
+// backendFor returns the language server registered for the language or file name.
+func (s *mateServer) backendFor(languageId, uri string) *languageServer {
+	for _, ls := range s.backends {
+		if ls.handles(languageId, "") {
+			return ls
+		}
+	}
+	for _, ls := range s.backends {
+		if ls.handles("", uri) {
+			return ls
+		}
+	}
+
+	return nil
+}
+
+// backendForCommand returns the language server that executes command.
+func (s *mateServer) backendForCommand(command string) *languageServer {
+	for _, ls := range s.backends {
+		for _, c := range ls.commands() {
+			if c == command {
+				return ls
+			}
+		}
+	}
+
+	return nil
+}
+
+// forwardToBackend sends an IDE request to the language server of its document.
+func (s *mateServer) forwardToBackend(mr mateRequest, method string, params documentParams, cb kvChan) {
+	if result := decodeRequest(mr.Body, params); result != nil {
+		cb <- result
+		return
+	}
+
+	cb <- s.requestBackend(mr.Context(), method, params)
+}
+
+// forwardLatest forwards a request like forwardToBackend, a previous request of
+// the same method for the same document still in flight is cancelled and
+// answered with the superseded status.
+func (s *mateServer) forwardLatest(mr mateRequest, method string, cb kvChan) {
+	params := positionRequest{}
+	if result := decodeRequest(mr.Body, &params); result != nil {
+		cb <- result
+		return
+	}
+	key := method + " " + params.TextDocument.URI
+
+	ctx, cancel := context.WithCancelCause(mr.Context())
+	current := &inflightRequest{cancel}
+	s.inflightMu.Lock()
+	if previous, ok := s.inflight[key]; ok {
+		previous.cancel(errSuperseded)
+	}
+	s.inflight[key] = current
+	s.inflightMu.Unlock()
+
+	result := s.requestBackend(ctx, method, params)
+
+	s.inflightMu.Lock()
+	if s.inflight[key] == current {
+		delete(s.inflight, key)
+	}
+	s.inflightMu.Unlock()
+	if errors.Is(context.Cause(ctx), errSuperseded) {
+		result = &KeyValue{"status": "superseded"}
+	}
+	cancel(nil)
+
+	cb <- result
 }
 
-func (s *mateServer) sendLSPRequest(out mrChan, method string, params KeyValue) *KeyValue {
-	cb := make(kvChan)
+// requestBackend sends a request to the language server of the document in params.
+func (s *mateServer) requestBackend(ctx context.Context, method string, params documentParams) *KeyValue {
+	languageId, uri := params.document()
+	ls := s.backendFor(languageId, uri)
+	if ls == nil {
+		return errorResult(errBackendUnavailable, "no language server for %s", languageId)
+	}
+
+	return s.sendLSPRequest(ctx, ls.in, method, params)
+}
+
+// sendLSPRequest sends a request to a backend and waits for the result until
+// ctx is done. The backend cancels its LSP request with the same context.
+func (s *mateServer) sendLSPRequest(ctx context.Context, out mrChan, method string, params interface{}) *KeyValue {
+	cb := make(kvChan, 1)
 	body, _ := json.Marshal(params)
-	out <- &mateRequest{
-		Method: method,
-		Body:   body,
-		CB:     cb,
+	select {
+	case out <- &mateRequest{Method: method, Body: body, CB: cb, ctx: ctx}:
+	case <-ctx.Done():
+		return contextError(ctx)
 	}
 
-	return <-cb
+	select {
+	case result := <-cb:
+		return result
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
+
+// syncCopilot queues a document notification for Copilot without waiting for
+// it, Copilot sees didOpen, didChange and didClose in the order they arrived.
+// Handlers call it holding the server lock, a full queue drops the notification.
+func (s *mateServer) syncCopilot(method string, params interface{}) {
+	if s.copilotSync == nil {
+		return
+	}
+	body, _ := json.Marshal(params)
+	select {
+	case s.copilotSync <- &mateRequest{Method: method, Body: body}:
+	default:
+		Log("Copilot is not reading, dropped %s", method)
+	}
 }
 
-func (s *mateServer) handlePanic(mr mateRequest) {
+// forwardCopilotSync passes the queued document notifications to Copilot one
+// at a time. Copilot only reads them once it is signed in, notifications it
+// does not take in time are dropped.
+func (s *mateServer) forwardCopilotSync() {
+	for mr := range s.copilotSync {
+		ctx, cancel := context.WithTimeout(context.Background(), config.timeout(mr.Method))
+		if e, ok := resultError(s.sendLSPRequest(ctx, s.copilot, mr.Method, json.RawMessage(mr.Body))); ok {
+			Log("Copilot %s failed: %s", mr.Method, e.Message)
+		}
+		cancel()
+	}
+}
+
+// replyContext returns a context that ends before ctx, so requests that
+// collect results until then can still answer in time.
+func replyContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithDeadline(ctx, deadline.Add(-time.Until(deadline)/10))
+}
+
+func (s *mateServer) handlePanic(mr mateRequest, cb kvChan) {
 	if err := recover(); err != nil {
 		Log("method: %s, bt: %s, Recovered from: %s", mr.Method, string(debug.Stack()), err)
+		select {
+		case cb <- errorResult(errInternal, "%v", err):
+		default:
+		}
 	}
 }
 
-func startServer(intelephense, copilot, volar, gopls mrChan, port string) {
-	Log("Running webserver on port: %s", port)
+// newServer sets up the server for the IDE API, copilot is nil when Copilot
+// is not started.
+func newServer(copilot mrChan, backends []*languageServer) {
 	server = mateServer{
-		intelephense: intelephense,
-		volar:        volar,
-		copilot:      copilot,
-		gopls:        gopls,
-		initialized:  false,
+		copilot:     copilot,
+		backends:    backends,
+		initialized: false,
 		logger: &Logger{
 			IncomingPrefix: "HTTP <-- IDE", OutgoingPrefix: "HTTP --> IDE",
 			HiColor: hiGreenString, LoColor: greenString, ErrorColor: errorString,
 		},
 		openFiles:   make(map[string]time.Time),
+		documents:   make(map[string]*document),
+		inflight:    make(map[string]*inflightRequest),
 		openFolders: make(map[string]lsp.DocumentURI),
 	}
+	if copilot != nil {
+		server.copilotSync = make(chan *mateRequest, 1024)
+		go server.forwardCopilotSync()
+	}
+}
+
+// startServer starts the webserver in the background and returns it for shutdown.
+// An optional webserver only logs that the port is taken, e.g. by the process
+// of another editor when LSP is served on stdio.
+func startServer(copilot mrChan, backends []*languageServer, port string, optional bool) *http.Server {
+	Log("Running webserver on port: %s", port)
+	newServer(copilot, backends)
+
+	srv := &http.Server{Addr: ":" + port, Handler: &server}
+	// event streams never go idle, end them so Shutdown does not wait for them
+	srv.RegisterOnShutdown(events.closeAll)
+	go func() {
+		err := srv.ListenAndServe()
+		if err == http.ErrServerClosed {
+			return
+		}
+		if !optional {
+			log.Fatal(err)
+		}
+		Log("IDE API is not available: %s", err)
+	}()
 
-	log.Fatal(http.ListenAndServe(":"+port, &server))
+	return srv
 }
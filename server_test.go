@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.bug.st/json"
+)
+
+func TestForwardLatestSupersedes(t *testing.T) {
+	backend := &languageServer{ServerConfig: ServerConfig{Name: "go", LanguageIds: []string{"go"}}, in: make(mrChan)}
+	newServer(nil, []*languageServer{backend})
+	s := &server
+
+	// the backend answers the first request only once it is cancelled
+	received := make(chan string, 3)
+	go func() {
+		for mr := range backend.in {
+			var params positionRequest
+			json.Unmarshal(mr.Body, &params)
+			received <- params.TextDocument.URI
+			if params.Position.Line == 0 {
+				go func(mr *mateRequest) {
+					<-mr.ctx.Done()
+					mr.CB <- contextError(mr.ctx)
+				}(mr)
+				continue
+			}
+			mr.CB <- &KeyValue{"status": "ok", "result": json.RawMessage(`"line 1"`)}
+		}
+	}()
+	request := func(uri string, line int) kvChan {
+		cb := make(kvChan, 1)
+		body := fmt.Sprintf(`{"textDocument":{"uri":%q},"languageId":"go","position":{"line":%d,"character":0}}`, uri, line)
+		go s.forwardLatest(mateRequest{Method: "hover", Body: json.RawMessage(body)}, "textDocument/hover", cb)
+		<-received
+		return cb
+	}
+	wait := func(cb kvChan) *KeyValue {
+		select {
+		case result := <-cb:
+			return result
+		case <-time.After(time.Second):
+			t.Fatal("no result")
+			return nil
+		}
+	}
+
+	first := request("/a.go", 0)
+	other := request("/b.go", 0)
+	second := request("/a.go", 1)
+
+	if result := wait(first); (*result)["status"] != "superseded" {
+		t.Errorf("first request: %v", *result)
+	}
+	if result := wait(second); (*result)["status"] != "ok" {
+		t.Errorf("second request: %v", *result)
+	}
+	select {
+	case result := <-other:
+		t.Errorf("request for another document was superseded: %v", *result)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
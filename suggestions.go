@@ -0,0 +1,236 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tectiv3/go-lsp"
+)
+
+// suggestionSession holds the Copilot suggestions shown at a cursor position
+// of a document version, index is the suggestion shown.
+type suggestionSession struct {
+	uri         string
+	position    lsp.Position
+	version     int
+	completions []Completion
+	index       int
+	// shown are the uuids of the suggestions shown, rejected unless accepted
+	shown []string
+	// accepted is the number of bytes of the display text accepted partially
+	accepted int
+	// following is set after a partial accept, the session moves on to the
+	// next version of the document instead of expiring
+	following bool
+}
+
+// suggestion is the shown suggestion of a session.
+type suggestion struct {
+	Completion Completion `json:"completion"`
+	Index      int        `json:"index"`
+	Count      int        `json:"count"`
+}
+
+func (session *suggestionSession) current() suggestion {
+	return suggestion{session.completions[session.index], session.index, len(session.completions)}
+}
+
+func (session *suggestionSession) show() suggestion {
+	shown := session.current()
+	for _, uuid := range session.shown {
+		if uuid == shown.Completion.UUID {
+			return shown
+		}
+	}
+	session.shown = append(session.shown, shown.Completion.UUID)
+
+	return shown
+}
+
+// rejected returns the uuids of the shown suggestions that were not accepted.
+func (session *suggestionSession) rejected() []string {
+	if session.accepted > 0 {
+		return nil
+	}
+
+	return session.shown
+}
+
+// suggestionSessions are the Copilot suggestion sessions by document uri, a
+// document has one session at the cursor position suggestions were requested.
+type suggestionSessions struct {
+	sessions map[string]*suggestionSession
+	// last is the uri of the latest session, used by requests without uri
+	last string
+	sync.Mutex
+}
+
+var suggestions = &suggestionSessions{sessions: map[string]*suggestionSession{}}
+
+// start replaces the session of the document, it returns the first suggestion
+// and the uuids rejected with the replaced session.
+func (ss *suggestionSessions) start(uri string, position lsp.Position, version int, completions []Completion) (suggestion, []string) {
+	ss.Lock()
+	defer ss.Unlock()
+	key := documentKey(uri)
+	var rejected []string
+	if previous, ok := ss.sessions[key]; ok {
+		rejected = previous.rejected()
+	}
+	session := &suggestionSession{uri: key, position: position, version: version, completions: completions}
+	ss.sessions[key] = session
+	ss.last = key
+
+	return session.show(), rejected
+}
+
+// session returns the session of uri, or of the latest document when uri is
+// empty. A session requested for another position has expired, the uuids
+// rejected with it are returned instead.
+func (ss *suggestionSessions) session(uri string, position *lsp.Position) (*suggestionSession, []string) {
+	key := ss.last
+	if len(uri) != 0 {
+		key = documentKey(uri)
+	}
+	session, ok := ss.sessions[key]
+	if !ok {
+		return nil, nil
+	}
+	if position != nil && *position != session.position {
+		delete(ss.sessions, key)
+		return nil, session.rejected()
+	}
+
+	return session, nil
+}
+
+// move shows the next (1) or previous (-1) suggestion, wrapping around. It
+// returns the uuids rejected with an expired session.
+func (ss *suggestionSessions) move(uri string, position *lsp.Position, step int) (suggestion, []string, bool) {
+	ss.Lock()
+	defer ss.Unlock()
+	session, rejected := ss.session(uri, position)
+	if session == nil || session.accepted > 0 {
+		return suggestion{}, rejected, false
+	}
+	count := len(session.completions)
+	session.index = ((session.index+step)%count + count) % count
+
+	return session.show(), nil, true
+}
+
+// end removes the session and returns it, accept and dismiss end a session.
+// It returns the uuids rejected with an expired session.
+func (ss *suggestionSessions) end(uri string, position *lsp.Position) (suggestionSession, []string, bool) {
+	ss.Lock()
+	defer ss.Unlock()
+	session, rejected := ss.session(uri, position)
+	if session == nil {
+		return suggestionSession{}, rejected, false
+	}
+	delete(ss.sessions, session.uri)
+
+	return *session, nil, true
+}
+
+// acceptPartial accepts the next word or line of the shown suggestion, it
+// returns the text to insert and the accepted length of the suggestion text
+// in UTF-16 code units. The session ends once the whole suggestion is accepted.
+func (ss *suggestionSessions) acceptPartial(uri string, position *lsp.Position, partial string) (suggestionSession, string, int, []string, bool) {
+	ss.Lock()
+	defer ss.Unlock()
+	session, rejected := ss.session(uri, position)
+	if session == nil {
+		return suggestionSession{}, "", 0, rejected, false
+	}
+	completion := session.current().Completion
+	rest := completion.DisplayText[session.accepted:]
+	insert := rest
+	if partial == "word" {
+		insert = nextWord(rest)
+	} else if i := strings.IndexByte(rest, '\n'); i >= 0 {
+		insert = rest[:i+1]
+	}
+	session.accepted += len(insert)
+	// Text also covers the part of the line before the cursor
+	prefix := utf16Len(completion.Text) - utf16Len(completion.DisplayText)
+	acceptedLength := prefix + utf16Len(completion.DisplayText[:session.accepted])
+
+	if session.accepted >= len(completion.DisplayText) {
+		delete(ss.sessions, session.uri)
+	} else {
+		session.position = advancePosition(session.position, insert)
+		session.following = true
+	}
+
+	return *session, insert, acceptedLength, nil, true
+}
+
+// nextWord returns the leading whitespace and the following word of text.
+func nextWord(text string) string {
+	i := 0
+	for i < len(text) && (text[i] == ' ' || text[i] == '\t') {
+		i++
+	}
+	word := strings.IndexFunc(text[i:], func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	if word == 0 {
+		// punctuation or a newline is accepted by itself
+		_, size := utf8.DecodeRuneInString(text[i:])
+		return text[:i+size]
+	}
+	if word < 0 {
+		return text
+	}
+
+	return text[:i+word]
+}
+
+// advancePosition returns the position after inserting text at p.
+func advancePosition(p lsp.Position, text string) lsp.Position {
+	if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+		return lsp.Position{Line: p.Line + strings.Count(text, "\n"), Character: utf16Len(text[i+1:])}
+	}
+
+	return lsp.Position{Line: p.Line, Character: p.Character + utf16Len(text)}
+}
+
+// expire removes the session of a document unless it belongs to version,
+// the suggestions do not apply to a changed document. It returns the uuids
+// rejected with the session.
+func (ss *suggestionSessions) expire(uri string, version int) []string {
+	ss.Lock()
+	defer ss.Unlock()
+	key := documentKey(uri)
+	session, ok := ss.sessions[key]
+	if !ok || session.version == version {
+		return nil
+	}
+	if session.following {
+		// the change inserted the partially accepted text
+		session.version = version
+		session.following = false
+		return nil
+	}
+	delete(ss.sessions, key)
+
+	return session.rejected()
+}
+
+// remove drops the session of a document that was opened or closed, it
+// returns the uuids rejected with the session.
+func (ss *suggestionSessions) remove(uri string) []string {
+	ss.Lock()
+	defer ss.Unlock()
+	key := documentKey(uri)
+	session, ok := ss.sessions[key]
+	if !ok {
+		return nil
+	}
+	delete(ss.sessions, key)
+
+	return session.rejected()
+}
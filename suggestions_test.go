@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tectiv3/go-lsp"
+)
+
+func TestSuggestionSessionExpiresByURI(t *testing.T) {
+	ss := &suggestionSessions{sessions: map[string]*suggestionSession{}}
+	completions := []Completion{{UUID: "a"}, {UUID: "b"}}
+	ss.start("/x/a.go", lsp.Position{Line: 1, Character: 2}, 1, completions)
+
+	rejected := ss.expire("file:///x/a.go", 2)
+	if len(rejected) != 1 || rejected[0] != "a" {
+		t.Fatalf("expected uuid a to be rejected, got %v", rejected)
+	}
+	if _, _, ok := ss.end("/x/a.go", nil); ok {
+		t.Fatal("session did not expire")
+	}
+}
+
+func TestSuggestionSessionMovedCursorRejects(t *testing.T) {
+	ss := &suggestionSessions{sessions: map[string]*suggestionSession{}}
+	ss.start("file:///x/a.go", lsp.Position{Line: 1, Character: 2}, 1, []Completion{{UUID: "a"}, {UUID: "b"}})
+	ss.move("file:///x/a.go", nil, 1)
+
+	_, rejected, ok := ss.move("file:///x/a.go", &lsp.Position{Line: 3}, 1)
+	if ok {
+		t.Fatal("session at another position was used")
+	}
+	if len(rejected) != 2 || rejected[0] != "a" || rejected[1] != "b" {
+		t.Fatalf("expected uuids a and b to be rejected, got %v", rejected)
+	}
+	if rejected := ss.remove("file:///x/a.go"); len(rejected) != 0 {
+		t.Fatalf("expired session still rejected %v", rejected)
+	}
+}
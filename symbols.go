@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tectiv3/go-lsp"
+	"go.bug.st/json"
+)
+
+// documentSymbol is an outline entry for the IDE. Line and Column point at the
+// symbol name, EndLine and EndColumn at the end of its whole range, all 1-based.
+type documentSymbol struct {
+	Name      string           `json:"name"`
+	Detail    string           `json:"detail,omitempty"`
+	Kind      string           `json:"kind"`
+	Line      int              `json:"line"`
+	Column    int              `json:"column"`
+	EndLine   int              `json:"endLine"`
+	EndColumn int              `json:"endColumn"`
+	Container string           `json:"container,omitempty"`
+	Depth     int              `json:"depth"`
+	Children  []documentSymbol `json:"children,omitempty"`
+}
+
+func symbolKindName(kind lsp.SymbolKind) string {
+	return strings.TrimPrefix(kind.String(), "SymbolKind:")
+}
+
+func newDocumentSymbol(s lsp.DocumentSymbol, container string, depth int) documentSymbol {
+	result := documentSymbol{
+		Name:      s.Name,
+		Detail:    s.Detail,
+		Kind:      symbolKindName(s.Kind),
+		Line:      s.SelectionRange.Start.Line + 1,
+		Column:    s.SelectionRange.Start.Character + 1,
+		EndLine:   s.Range.End.Line + 1,
+		EndColumn: s.Range.End.Character + 1,
+		Container: container,
+		Depth:     depth,
+	}
+	for _, child := range s.Children {
+		result.Children = append(result.Children, newDocumentSymbol(child, s.Name, depth+1))
+	}
+
+	return result
+}
+
+// normalizeDocumentSymbols converts a DocumentSymbol[] | SymbolInformation[] | null result
+// to an outline. SymbolInformation has no hierarchy, so its outline is flat.
+func normalizeDocumentSymbols(resp json.RawMessage) ([]documentSymbol, error) {
+	result := []documentSymbol{}
+	if len(resp) == 0 || string(resp) == "null" {
+		return result, nil
+	}
+
+	var symbols []lsp.DocumentSymbol
+	if err := json.Unmarshal(resp, &symbols); err == nil {
+		for _, s := range symbols {
+			result = append(result, newDocumentSymbol(s, "", 0))
+		}
+		return result, nil
+	}
+	var information []lsp.SymbolInformation
+	if err := json.Unmarshal(resp, &information); err != nil {
+		return nil, fmt.Errorf("unexpected documentSymbol result: %w", err)
+	}
+	for _, s := range information {
+		l := newLocation(s.Location.URI, s.Location.Range)
+		result = append(result, documentSymbol{
+			Name:      s.Name,
+			Kind:      symbolKindName(s.Kind),
+			Line:      l.Line,
+			Column:    l.Column,
+			EndLine:   l.EndLine,
+			EndColumn: l.EndColumn,
+			Container: s.ContainerName,
+		})
+	}
+
+	return result, nil
+}
+
+// flattenSymbols lists the outline depth first, for a "Go to Symbol" list.
+func flattenSymbols(symbols []documentSymbol) []documentSymbol {
+	result := []documentSymbol{}
+	for _, s := range symbols {
+		children := s.Children
+		s.Children = nil
+		result = append(result, s)
+		result = append(result, flattenSymbols(children)...)
+	}
+
+	return result
+}
+
+// workspaceSymbol is a workspace/symbol result for the IDE, merged across servers.
+type workspaceSymbol struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Container string `json:"container,omitempty"`
+	Path      string `json:"path"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	Server    string `json:"server"`
+}
+
+// normalizeWorkspaceSymbols converts a SymbolInformation[] | WorkspaceSymbol[] | null result,
+// WorkspaceSymbol locations may come without a range.
+func normalizeWorkspaceSymbols(resp json.RawMessage, server string) ([]workspaceSymbol, error) {
+	result := []workspaceSymbol{}
+	if len(resp) == 0 || string(resp) == "null" {
+		return result, nil
+	}
+
+	var symbols []struct {
+		Name          string         `json:"name"`
+		Kind          lsp.SymbolKind `json:"kind"`
+		ContainerName string         `json:"containerName"`
+		Location      struct {
+			URI   lsp.DocumentURI `json:"uri"`
+			Range *lsp.Range      `json:"range"`
+		} `json:"location"`
+	}
+	if err := json.Unmarshal(resp, &symbols); err != nil {
+		return nil, fmt.Errorf("unexpected workspace/symbol result: %w", err)
+	}
+	for _, s := range symbols {
+		r := lsp.Range{}
+		if s.Location.Range != nil {
+			r = *s.Location.Range
+		}
+		l := newLocation(s.Location.URI, r)
+		result = append(result, workspaceSymbol{
+			Name:      s.Name,
+			Kind:      symbolKindName(s.Kind),
+			Container: s.ContainerName,
+			Path:      l.Path,
+			Line:      l.Line,
+			Column:    l.Column,
+			Server:    server,
+		})
+	}
+
+	return result, nil
+}
+
+// symbolRank scores how well name matches query, lower is better.
+func symbolRank(name, query string) int {
+	lowerName, lowerQuery := strings.ToLower(name), strings.ToLower(query)
+	switch {
+	case name == query:
+		return 0
+	case lowerName == lowerQuery:
+		return 1
+	case strings.HasPrefix(name, query):
+		return 2
+	case strings.HasPrefix(lowerName, lowerQuery):
+		return 3
+	case strings.Contains(lowerName, lowerQuery):
+		return 4
+	}
+	return 5
+}
+
+// rankWorkspaceSymbols removes symbols reported twice for the same location and
+// sorts the rest by match quality, symbols inside dir first.
+func rankWorkspaceSymbols(symbols []workspaceSymbol, query, dir string) []workspaceSymbol {
+	seen := map[string]bool{}
+	result := []workspaceSymbol{}
+	for _, s := range symbols {
+		key := fmt.Sprintf("%s:%d:%d:%s", s.Path, s.Line, s.Column, s.Name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, s)
+	}
+
+	inDir := func(s workspaceSymbol) bool {
+		return len(dir) != 0 && inFolder(s.Path, dir)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if ra, rb := symbolRank(a.Name, query), symbolRank(b.Name, query); ra != rb {
+			return ra < rb
+		}
+		if ia, ib := inDir(a), inDir(b); ia != ib {
+			return ia
+		}
+		if len(a.Name) != len(b.Name) {
+			return len(a.Name) < len(b.Name)
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Line < b.Line
+	})
+
+	return result
+}
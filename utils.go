@@ -6,7 +6,9 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime/debug"
+	"strings"
 
 	lsp "github.com/tectiv3/go-lsp"
 	"go.bug.st/json"
@@ -62,6 +64,143 @@ func readConfig(configPath string) {
 	}
 }
 
+// documentURI parses the uri of a document, the IDE sends file uris or
+// absolute paths.
+func documentURI(uri string) (lsp.DocumentURI, error) {
+	if filepath.IsAbs(uri) {
+		return lsp.NewDocumentURI(uri), nil
+	}
+
+	return lsp.NewDocumentURIFromURL(uri)
+}
+
+// documentKey is the uri string documents are kept under, the IDE sends file
+// uris or paths.
+func documentKey(uri string) string {
+	if docURI, err := documentURI(uri); err == nil {
+		return docURI.String()
+	}
+
+	return uri
+}
+
+// inFolder reports whether the uri or path is the folder or lies below it,
+// an empty folder contains everything.
+func inFolder(uri, folder string) bool {
+	if len(folder) == 0 || uri == folder {
+		return true
+	}
+
+	return strings.HasPrefix(uri, strings.TrimSuffix(folder, "/")+"/")
+}
+
+// newLocation converts an LSP range in uri to a location.
+func newLocation(uri lsp.DocumentURI, r lsp.Range) location {
+	return location{
+		Path:      uri.AsPath().String(),
+		Line:      r.Start.Line + 1,
+		Column:    r.Start.Character + 1,
+		EndLine:   r.End.Line + 1,
+		EndColumn: r.End.Character + 1,
+	}
+}
+
+// normalizeLocations converts a Location | Location[] | LocationLink[] | null result to locations.
+func normalizeLocations(resp json.RawMessage) ([]location, error) {
+	result := []location{}
+	if len(resp) == 0 || string(resp) == "null" {
+		return result, nil
+	}
+
+	var single lsp.Location
+	if err := json.Unmarshal(resp, &single); err == nil {
+		return append(result, newLocation(single.URI, single.Range)), nil
+	}
+	var locations []lsp.Location
+	if err := json.Unmarshal(resp, &locations); err == nil {
+		for _, l := range locations {
+			result = append(result, newLocation(l.URI, l.Range))
+		}
+		return result, nil
+	}
+	var links []lsp.LocationLink
+	if err := json.Unmarshal(resp, &links); err != nil {
+		return nil, fmt.Errorf("unexpected locations result: %w", err)
+	}
+	for _, l := range links {
+		result = append(result, newLocation(l.TargetUri, l.TargetSelectionRange))
+	}
+
+	return result, nil
+}
+
+// markupText returns the text and kind of a string | MarkupContent value.
+func markupText(raw json.RawMessage) (string, string) {
+	if len(raw) == 0 {
+		return "", ""
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, string(lsp.MarkupKindPlainText)
+	}
+	var markup lsp.MarkupContent
+	if err := json.Unmarshal(raw, &markup); err == nil {
+		return markup.Value, string(markup.Kind)
+	}
+
+	return "", ""
+}
+
+// newSignatureHelp picks the active signature and parameter of help.
+func newSignatureHelp(help lsp.SignatureHelp) *signatureHelp {
+	if len(help.Signatures) == 0 {
+		return nil
+	}
+	active := 0
+	if help.ActiveSignature != nil && *help.ActiveSignature < len(help.Signatures) {
+		active = *help.ActiveSignature
+	}
+	signature := help.Signatures[active]
+	result := &signatureHelp{
+		Label:           signature.Label,
+		ActiveSignature: active,
+		Signatures:      len(help.Signatures),
+		Format:          string(lsp.MarkupKindPlainText),
+	}
+	var kind string
+	result.Documentation, kind = markupText(signature.Documentation)
+	if kind == string(lsp.MarkupKindMarkdown) {
+		result.Format = kind
+	}
+
+	parameter := help.ActiveParameter
+	if signature.ActiveParameter != nil {
+		parameter = signature.ActiveParameter
+	}
+	if parameter == nil || *parameter < 0 || *parameter >= len(signature.Parameters) {
+		return result
+	}
+	info := signature.Parameters[*parameter]
+	// the label is either a string or [start, end] offsets in the signature label
+	var offsets [2]int
+	if err := json.Unmarshal(info.Label, &offsets); err == nil {
+		// invalid offsets leave the parameter out
+		if offsets[0] >= 0 && offsets[0] <= offsets[1] && offsets[1] <= utf16Len(signature.Label) {
+			start := positionOffset(signature.Label, lsp.Position{Character: offsets[0]})
+			end := positionOffset(signature.Label, lsp.Position{Character: offsets[1]})
+			result.ActiveParameter = signature.Label[start:end]
+		}
+	} else {
+		json.Unmarshal(info.Label, &result.ActiveParameter)
+	}
+	result.ParameterDocumentation, kind = markupText(info.Documentation)
+	if kind == string(lsp.MarkupKindMarkdown) {
+		result.Format = kind
+	}
+
+	return result
+}
+
 func applyTextmateMarks(uuid string, diagnostics *lsp.PublishDiagnosticsParams) {
 	// Clear all marks first
 	args := []string{"--uuid", uuid, "--clear-mark=note", "--clear-mark=warning", "--clear-mark=error"}
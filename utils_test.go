@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tectiv3/go-lsp"
+	"go.bug.st/json"
+)
+
+func TestNewSignatureHelp(t *testing.T) {
+	tests := []struct {
+		name   string
+		params string
+		want   string
+	}{
+		{"string label", `"b int"`, "b int"},
+		{"offsets", `[8, 13]`, "b int"},
+		{"utf-16 offsets", `[0, 5]`, "f(a 😀"},
+		{"inverted offsets", `[5, 3]`, ""},
+		{"end past label", `[7, 40]`, ""},
+		{"negative start", `[-1, 3]`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			help := lsp.SignatureHelp{}
+			body := `{"signatures":[{"label":"f(a 😀, b int)","parameters":[{"label":` + tt.params + `}]}],"activeParameter":0}`
+			if err := json.Unmarshal([]byte(body), &help); err != nil {
+				t.Fatal(err)
+			}
+			result := newSignatureHelp(help)
+			if result == nil || result.Label != "f(a 😀, b int)" {
+				t.Fatalf("signature missing: %+v", result)
+			}
+			if result.ActiveParameter != tt.want {
+				t.Errorf("active parameter %q, want %q", result.ActiveParameter, tt.want)
+			}
+		})
+	}
+}
+
+func TestDocumentURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"/x/a.go", "file:///x/a.go"},
+		{"file:///x/a.go", "file:///x/a.go"},
+		{"/x/my file.go", "file:///x/my%20file.go"},
+		{"file:///x/my%20file.go", "file:///x/my%20file.go"},
+	}
+	for _, tt := range tests {
+		uri, err := documentURI(tt.uri)
+		if err != nil {
+			t.Errorf("%s: %v", tt.uri, err)
+			continue
+		}
+		if uri.String() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.uri, uri, tt.want)
+		}
+	}
+	if _, err := documentURI("file://%zz"); err == nil {
+		t.Error("invalid uri was accepted")
+	}
+}
+
+func TestNormalizeLocations(t *testing.T) {
+	r := `{"start":{"line":1,"character":2},"end":{"line":1,"character":5}}`
+	wide := `{"start":{"line":0,"character":0},"end":{"line":3,"character":1}}`
+	tests := []struct {
+		name string
+		resp string
+		want []location
+	}{
+		{"null", `null`, []location{}},
+		{"empty", ``, []location{}},
+		{"location", `{"uri":"file:///x/a.go","range":` + r + `}`, []location{{Path: "/x/a.go", Line: 2, Column: 3, EndLine: 2, EndColumn: 6}}},
+		{
+			"locations", `[{"uri":"file:///x/a.go","range":` + r + `},{"uri":"file:///x/b.go","range":` + wide + `}]`,
+			[]location{{Path: "/x/a.go", Line: 2, Column: 3, EndLine: 2, EndColumn: 6}, {Path: "/x/b.go", Line: 1, Column: 1, EndLine: 4, EndColumn: 2}},
+		},
+		{
+			"location links", `[{"targetUri":"file:///x/a.go","targetRange":` + wide + `,"targetSelectionRange":` + r + `}]`,
+			[]location{{Path: "/x/a.go", Line: 2, Column: 3, EndLine: 2, EndColumn: 6}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeLocations(json.RawMessage(tt.resp))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %v, want %v", got[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	if _, err := normalizeLocations(json.RawMessage(`"a.go"`)); err == nil {
+		t.Error("invalid result was accepted")
+	}
+}
+
+func TestInFolder(t *testing.T) {
+	tests := []struct {
+		uri, folder string
+		want        bool
+	}{
+		{"file:///ws/a.go", "", true},
+		{"file:///ws/a.go", "file:///ws", true},
+		{"file:///ws/a.go", "file:///ws/", true},
+		{"file:///ws", "file:///ws", true},
+		{"file:///ws/pkg/a.go", "file:///ws", true},
+		{"file:///ws2/a.go", "file:///ws", false},
+		{"file:///w/a.go", "file:///ws", false},
+		{"/ws/a.go", "/ws", true},
+	}
+	for _, tt := range tests {
+		if got := inFolder(tt.uri, tt.folder); got != tt.want {
+			t.Errorf("inFolder(%q, %q) = %v, want %v", tt.uri, tt.folder, got, tt.want)
+		}
+	}
+}